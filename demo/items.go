@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"fmt"
+	gsrv "garzon/server"
 	"regexp"
 	T "html/template"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,6 +15,7 @@ import (
 type Item struct {
 	Title, Root, Path string
 	Items             []*Item
+	Manifest          *gsrv.Manifest // only problems with 'problem.json'
 }
 
 func NewItem(absdir, root string) (I *Item) {
@@ -24,6 +27,15 @@ func NewItem(absdir, root string) (I *Item) {
 		panic(err)
 	}
 	I.Path = path
+	if gsrv.HasManifest(absdir) {
+		m, err := gsrv.ReadManifest(absdir)
+		if err != nil {
+			log.Printf("Problem '%s': %s", path, err)
+			return
+		}
+		I.Title = m.Title
+		I.Manifest = &m
+	}
 	return
 }
 
@@ -45,7 +57,7 @@ func (I *Item) Find(path string) *Item {
 		base, rest = path[:i], path[i+1:]
 	}
 	for _, item := range I.Items {
-		if base == item.Title {
+		if base == filepath.Base(item.Path) {
 			return item.Find(rest)
 		}
 	}
@@ -53,12 +65,17 @@ func (I *Item) Find(path string) *Item {
 }
 
 func (I *Item) Read() {
-	if subdirs := subdirs(I.Dir()); len(subdirs) > 0 {
-		I.Items = make([]*Item, len(subdirs))
-		for i := range I.Items {
-			I.Items[i] = NewItem(subdirs[i], I.Root)
-			I.Items[i].Read()
+	if I.Manifest != nil {
+		return // a problem, its subdirectories are not items
+	}
+	I.Items = nil
+	for _, dir := range subdirs(I.Dir()) {
+		item := NewItem(dir, I.Root)
+		if item.Manifest != nil && item.Manifest.Hidden {
+			continue
 		}
+		item.Read()
+		I.Items = append(I.Items, item)
 	}
 }
 
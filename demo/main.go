@@ -2,11 +2,13 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"context"
 	"fmt"
 	gsrv "garzon/server"
 	T "html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -29,6 +31,15 @@ func init() {
 		*path = "."
 	}
 	ReadCourses(*path)
+	gsrv.WorkerSecret = os.Getenv("GARZON_SECRET")
+	gsrv.AdminToken = os.Getenv("GARZON_ADMIN_TOKEN")
+	if dir := os.Getenv("GARZON_STORE"); dir != "" {
+		store, err := gsrv.OpenStore(dir)
+		if err != nil {
+			log.Fatalf("Cannot open store: %s", err)
+		}
+		gsrv.SubmStore = store
+	}
 	gsrv.Handle()
 }
 
@@ -38,13 +49,35 @@ func newSubmission(ws *websocket.Conn) {
 	if err != nil {
 		log.Printf("Error receiving job: %s", err)
 	}
-	veredict, err := gsrv.Judge(subm, func(msg string) {
+	// Who submits is decided here, not by the browser (there are no
+	// accounts, so it is the address of the browser)
+	subm.ID, subm.User = "", clientAddr(ws.Request())
+
+	// Stop judging if the browser goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		var discard string
+		websocket.Message.Receive(ws, &discard)
+		cancel()
+	}()
+
+	verdict, err := gsrv.JudgeContext(ctx, subm, func(msg string) {
 		websocket.JSON.Send(ws, msg)
 	})
 	if err != nil {
-		veredict = fmt.Sprintf("Error: %s", err)
+		websocket.JSON.Send(ws, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	websocket.JSON.Send(ws, verdict.String())
+}
+
+func clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
 	}
-	websocket.JSON.Send(ws, veredict)
+	return host
 }
 
 var tmpl = T.Must(T.ParseFiles("templates.html"))
@@ -0,0 +1,131 @@
+// Package grztest runs a server and workers with Fake sandboxes in the
+// same process, connected through a real websocket, so that the whole
+// path of a submission (submit, dispatch, progress and verdict) can be
+// tested with 'go test'. For instance:
+//
+//	h, err := grztest.Start("testdata/problems")
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer h.Close()
+//	h.AddWorker(1, func(slot int) *worker.Fake {
+//		return worker.NewFake(func(solution []byte) ([]string, string) {
+//			return []string{"Test 1: OK"}, "Wrong Answer\nTest 2 failed"
+//		})
+//	})
+//	verdict, progress, err := h.Judge(server.Submission{ProblemID: "sum"})
+//
+// The problems must have a custom judge (a 'judge.*' file, which is not
+// compiled nor run: the Fake gives the verdict).
+package grztest
+
+import (
+	"fmt"
+	"garzon/server"
+	"garzon/worker"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret shared by the server and the workers of a Harness.
+const Secret = "grztest"
+
+// How long AddWorker waits for the server to see the new worker.
+var ConnectTimeout = 10 * time.Second
+
+// A Harness is a server listening on a local port and the workers
+// connected to it.
+type Harness struct {
+	Server  *server.Server
+	Addr    string // of the server (host:port)
+	Workers []*worker.Worker
+
+	http *httptest.Server
+	dir  string // home directories of the workers
+}
+
+// Start starts a server for the problems in problemPath.
+func Start(problemPath string) (*Harness, error) {
+	dir, err := ioutil.TempDir("", "grztest")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create temp dir: %s", err)
+	}
+	srv := server.New(problemPath)
+	srv.WorkerSecret = Secret
+	srv.PingInterval = 100 * time.Millisecond // to notice dead workers soon
+	mux := http.NewServeMux()
+	srv.Register(mux)
+	ts := httptest.NewServer(mux)
+	return &Harness{
+		Server: srv,
+		Addr:   strings.TrimPrefix(ts.URL, "http://"),
+		http:   ts,
+		dir:    dir,
+	}, nil
+}
+
+// AddWorker starts a worker with vms slots, whose sandboxes are made by
+// newFake (or are NewFake(nil) if it is nil), and waits until they are
+// connected to the server.
+func (h *Harness) AddWorker(vms int, newFake func(slot int) *worker.Fake) (*worker.Worker, error) {
+	w := worker.New(h.Addr)
+	w.Secret = Secret
+	w.SandboxType = worker.FakeSandbox
+	w.VMs = vms
+	w.HomeDir = filepath.Join(h.dir, fmt.Sprintf("worker-%d", len(h.Workers)))
+	w.NewSandbox = func(slot int, dir string) (worker.Sandbox, error) {
+		if newFake == nil {
+			return worker.NewFake(nil), nil
+		}
+		return newFake(slot), nil
+	}
+	if err := w.Start(); err != nil {
+		return nil, err
+	}
+	connected := len(h.Server.Workers())
+	h.Workers = append(h.Workers, w)
+	go w.Serve()
+	return w, h.WaitWorkers(connected + vms)
+}
+
+// WaitWorkers waits until there are n workers connected to the server.
+func (h *Harness) WaitWorkers(n int) error {
+	deadline := time.Now().Add(ConnectTimeout)
+	for len(h.Server.Workers()) != n {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("There are %d workers instead of %d", len(h.Server.Workers()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// Judge evaluates a submission and returns the verdict and the progress
+// messages received.
+func (h *Harness) Judge(subm server.Submission) (verdict server.Verdict, progress []string, err error) {
+	var mu sync.Mutex
+	verdict, err = h.Server.Judge(subm, func(msg string) {
+		mu.Lock()
+		progress = append(progress, msg)
+		mu.Unlock()
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	return verdict, progress, err
+}
+
+// Close stops the workers and the server, and removes the directories
+// of the workers.
+func (h *Harness) Close() {
+	for _, w := range h.Workers {
+		w.Close()
+	}
+	h.http.Close()
+	os.RemoveAll(h.dir)
+}
@@ -0,0 +1,574 @@
+package grztest_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"garzon/grztest"
+	"garzon/server"
+	"garzon/worker"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// sumJudge is the Judge of the Fakes: it accepts "ok" and gives Wrong
+// Answer otherwise, after a progress message for each test. "slow"
+// solutions have many tests.
+func sumJudge(solution []byte) (progress []string, output string) {
+	ntests := 2
+	if string(solution) == "slow" {
+		ntests = 100
+	}
+	for i := 1; i <= ntests; i++ {
+		progress = append(progress, fmt.Sprintf("Test %d", i))
+	}
+	if string(solution) == "ok" {
+		return progress, "Accepted\n"
+	}
+	return progress, fmt.Sprintf("Wrong Answer\nExpected 'ok', got '%s'\n", solution)
+}
+
+func start(t *testing.T) *grztest.Harness {
+	h, err := grztest.Start("testdata/problems")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func addWorker(t *testing.T, h *grztest.Harness, judge func([]byte) ([]string, string), delay time.Duration) *worker.Worker {
+	w, err := h.AddWorker(1, func(int) *worker.Fake {
+		f := worker.NewFake(judge)
+		f.Delay = delay
+		return f
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// metric returns the value of a counter of the server's /metrics.
+func metric(t *testing.T, h *grztest.Harness, name string) (value int) {
+	resp, err := http.Get("http://" + h.Addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), name+" ") {
+			fmt.Sscan(strings.TrimPrefix(scanner.Text(), name+" "), &value)
+			return value
+		}
+	}
+	t.Fatalf("Metric '%s' not found", name)
+	return 0
+}
+
+func TestVerdictAndProgress(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	addWorker(t, h, sumJudge, 0)
+
+	verdict, progress, err := h.Judge(server.Submission{ProblemID: "sum", Data: []byte("bad")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Status != server.WrongAnswer || verdict.Message != "Expected 'ok', got 'bad'\n" {
+		t.Errorf("Verdict: %+v", verdict)
+	}
+	want := []string{"In queue", "Preparing...", "Test 1", "Test 2"}
+	if !reflect.DeepEqual(progress, want) {
+		t.Errorf("Progress: %q, want %q", progress, want)
+	}
+}
+
+func TestProblemCache(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	w := addWorker(t, h, sumJudge, 0)
+
+	if _, _, err := h.Judge(server.Submission{ProblemID: "sum", Data: []byte("bad")}); err != nil {
+		t.Fatal(err)
+	}
+	sent := metric(t, h, "garzon_problem_transfer_bytes_total")
+	if sent == 0 {
+		t.Fatalf("The problem was not sent to the worker")
+	}
+	verdict, _, err := h.Judge(server.Submission{ProblemID: "sum", Data: []byte("ok"), Language: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Status != server.Accepted {
+		t.Errorf("Verdict: %+v", verdict)
+	}
+	if again := metric(t, h, "garzon_problem_transfer_bytes_total"); again != sent {
+		t.Errorf("The problem was sent again (%d bytes, then %d)", sent, again)
+	}
+	if n := w.CachedProblems(); n != 1 {
+		t.Errorf("%d problems in the cache of the worker, want 1", n)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	addWorker(t, h, sumJudge, 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := time.Now()
+	_, err := h.Server.JudgeContext(ctx, server.Submission{ProblemID: "sum", Data: []byte("slow")}, func(msg string) {
+		if msg == "Test 1" {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Errorf("JudgeContext returned %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("JudgeContext took %s to give up", elapsed)
+	}
+
+	// The worker stops the job and takes the next one
+	verdict, _, err := h.Judge(server.Submission{ProblemID: "sum", Data: []byte("ok")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Status != server.Accepted {
+		t.Errorf("Verdict after cancelling: %+v", verdict)
+	}
+}
+
+func TestWorkerClosedMidJob(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	// The first worker never finishes (and would give Wrong Answer)
+	slow := addWorker(t, h, func([]byte) ([]string, string) {
+		return []string{"Test 1"}, "Wrong Answer\n"
+	}, time.Hour)
+
+	preparing := make(chan bool, 10)
+	type result struct {
+		verdict server.Verdict
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		verdict, err := h.Server.Judge(server.Submission{ProblemID: "sum", Data: []byte("ok")}, func(msg string) {
+			if msg == "Preparing..." {
+				preparing <- true
+			}
+		})
+		done <- result{verdict, err}
+	}()
+	select {
+	case <-preparing:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The job did not reach the worker")
+	}
+
+	addWorker(t, h, sumJudge, 0)
+	slow.Close()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.verdict.Status != server.Accepted {
+			t.Errorf("Verdict: %+v, want the one of the second worker", res.verdict)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The job was not given to the second worker")
+	}
+}
+
+func TestQueueTimeoutAfterRequeue(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	h.Server.QueueTimeout = 200 * time.Millisecond
+	slow := addWorker(t, h, sumJudge, time.Hour)
+
+	preparing := make(chan bool, 10)
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.Server.Judge(server.Submission{ProblemID: "sum", Data: []byte("ok")}, func(msg string) {
+			if msg == "Preparing..." {
+				preparing <- true
+			}
+		})
+		done <- err
+	}()
+	select {
+	case <-preparing:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The job did not reach the worker")
+	}
+
+	// Back in the queue, with no workers, the job waits QueueTimeout again
+	time.Sleep(2 * h.Server.QueueTimeout)
+	slow.Close()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "No worker responding") {
+			t.Errorf("Judge returned %v, want a queue timeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The requeued job waited for ever")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+
+	// A busy worker answers pings
+	addWorker(t, h, sumJudge, 4*h.Server.PingInterval)
+	verdict, _, err := h.Judge(server.Submission{ProblemID: "sum", Data: []byte("ok")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Status != server.Accepted {
+		t.Errorf("Verdict of a slow job: %+v", verdict)
+	}
+
+	// A worker that says nothing after the handshake is given up for dead
+	ws, err := websocket.Dial("ws://"+h.Addr+"/_new_worker", "", "http://"+h.Addr+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := server.Send(ws, server.MsgHello, "", server.Capabilities{}); err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := server.Expect(ws, server.MsgChallenge, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce string
+	if err := challenge.Decode(&nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Send(ws, server.MsgAuth, "", server.Sign(grztest.Secret, nonce)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Expect(ws, server.MsgWelcome, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.WaitWorkers(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.WaitWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	if n := metric(t, h, "garzon_worker_heartbeat_timeouts_total"); n != 1 {
+		t.Errorf("%d heartbeat timeouts, want 1", n)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	home, err := ioutil.TempDir("", "grztest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	w := worker.New(h.Addr)
+	w.Secret = "wrong"
+	w.SandboxType = worker.FakeSandbox
+	w.HomeDir = home
+	w.NewSandbox = func(int, string) (worker.Sandbox, error) {
+		return worker.NewFake(nil), nil
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	done := make(chan error, 1)
+	go func() { done <- w.Serve() }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "Rejected") {
+			t.Errorf("Serve returned %v, want a rejection", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve did not give up")
+	}
+	if n := len(h.Server.Workers()); n != 0 {
+		t.Errorf("%d workers connected", n)
+	}
+	if n := metric(t, h, "garzon_workers_rejected_total"); n != 1 {
+		t.Errorf("%d workers rejected, want 1", n)
+	}
+}
+
+// waitRejudge waits until a rejudge started with StartRejudge is done.
+func waitRejudge(t *testing.T, h *grztest.Harness, id string) server.RejudgeTask {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		task, ok := h.Server.RejudgeStatus(id)
+		if !ok {
+			t.Fatalf("Rejudge '%s' not found", id)
+		}
+		if task.Done {
+			return task
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Rejudge '%s' did not finish", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func openStore(t *testing.T, h *grztest.Harness) (dir string) {
+	dir, err := ioutil.TempDir("", "grztest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Server.Store, err = server.OpenStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRejudge(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	defer os.RemoveAll(openStore(t, h))
+	var fixed int32 // the judge accepts everything once it is fixed
+	addWorker(t, h, func(solution []byte) ([]string, string) {
+		if atomic.LoadInt32(&fixed) == 1 {
+			return nil, "Accepted\n"
+		}
+		return sumJudge(solution)
+	}, 0)
+
+	if _, _, err := h.Judge(server.Submission{ProblemID: "sum", Data: []byte("bad")}); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&fixed, 1)
+
+	// Two rejudges at the same time keep both old verdicts
+	id1, err := h.Server.StartRejudge(server.Query{ProblemID: "sum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := h.Server.StartRejudge(server.Query{ProblemID: "sum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{id1, id2} {
+		task := waitRejudge(t, h, id)
+		if len(task.Results) != 1 || task.Results[0].Error != "" {
+			t.Fatalf("Results of rejudge '%s': %+v", id, task.Results)
+		}
+	}
+	task, _ := h.Server.RejudgeStatus(id1)
+	if res := task.Results[0]; res.Old == nil || res.Old.Status != server.WrongAnswer || res.New.Status != server.Accepted || !res.Changed {
+		t.Errorf("Result of the first rejudge: %+v", res)
+	}
+	rec, _ := h.Server.Store.Get(task.Results[0].ID)
+	if rec.Verdict == nil || rec.Verdict.Status != server.Accepted || len(rec.Previous) != 2 || rec.Previous[0].Status != server.WrongAnswer {
+		t.Errorf("Record after two rejudges: verdict %+v, previous %+v", rec.Verdict, rec.Previous)
+	}
+}
+
+func TestCancelRejudge(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	defer os.RemoveAll(openStore(t, h))
+	addWorker(t, h, sumJudge, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, _, err := h.Judge(server.Submission{ProblemID: "sum", Data: []byte("ok")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// (the submissions are slow now)
+	for _, rec := range h.Server.Store.Find(server.Query{}) {
+		rec.Data = []byte("slow")
+		if err := h.Server.Store.Update(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, err := h.Server.StartRejudge(server.Query{ProblemID: "sum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !h.Server.CancelRejudge(id) {
+		t.Fatalf("Rejudge '%s' not found", id)
+	}
+	task := waitRejudge(t, h, id)
+	for _, res := range task.Results {
+		if res.Error == "" || res.New != nil {
+			t.Errorf("Result after cancelling: %+v", res)
+		}
+	}
+	for _, rec := range h.Server.Store.Find(server.Query{}) {
+		if rec.Verdict == nil || rec.Verdict.Status != server.Accepted || len(rec.Previous) != 0 {
+			t.Errorf("Record after a cancelled rejudge: verdict %+v, previous %+v", rec.Verdict, rec.Previous)
+		}
+	}
+}
+
+// admin makes a request to the admin API and decodes its reply into v
+// (if it is not nil and the request succeeds).
+func admin(t *testing.T, h *grztest.Harness, method, path, token string, v interface{}) (status int) {
+	req, err := http.NewRequest(method, "http://"+h.Addr+"/admin/"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s /admin/%s: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	if status := admin(t, h, "GET", "workers", "", nil); status != http.StatusForbidden {
+		t.Errorf("Status without AdminToken: %d", status)
+	}
+	h.Server.AdminToken = "secret"
+	if status := admin(t, h, "GET", "workers", "wrong", nil); status != http.StatusUnauthorized {
+		t.Errorf("Status with a wrong token: %d", status)
+	}
+	if status := admin(t, h, "GET", "workers", "secret", nil); status != http.StatusOK {
+		t.Errorf("Status with the token: %d", status)
+	}
+	if status := admin(t, h, "GET", "nothing", "secret", nil); status != http.StatusNotFound {
+		t.Errorf("Status of an unknown path: %d", status)
+	}
+}
+
+func TestAdminWorkersAndJobs(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	h.Server.AdminToken = "secret"
+	addWorker(t, h, sumJudge, 50*time.Millisecond)
+
+	var workers []server.WorkerInfo
+	if admin(t, h, "GET", "workers", "secret", &workers); len(workers) != 1 {
+		t.Fatalf("Workers: %+v", workers)
+	}
+	id := workers[0].ID
+	if status := admin(t, h, "POST", "workers/"+id+"/drain", "secret", nil); status != http.StatusOK || !h.Server.Workers()[0].Draining {
+		t.Errorf("The worker is not draining (status %d)", status)
+	}
+	if status := admin(t, h, "POST", "workers/"+id+"/resume", "secret", nil); status != http.StatusOK || h.Server.Workers()[0].Draining {
+		t.Errorf("The worker is still draining (status %d)", status)
+	}
+	if status := admin(t, h, "POST", "workers/none/drain", "secret", nil); status != http.StatusNotFound {
+		t.Errorf("Status of an unknown worker: %d", status)
+	}
+
+	// A running job can be cancelled
+	started := make(chan bool, 100)
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.Server.Judge(server.Submission{ProblemID: "sum", Data: []byte("slow")}, func(msg string) {
+			if msg == "Test 1" {
+				started <- true
+			}
+		})
+		done <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The job did not start")
+	}
+	var jobs map[string][]server.JobInfo
+	admin(t, h, "GET", "jobs", "secret", &jobs)
+	if len(jobs["Queued"]) != 0 || len(jobs["Running"]) != 1 || jobs["Running"][0].Worker != id {
+		t.Fatalf("Jobs: %+v", jobs)
+	}
+	if status := admin(t, h, "POST", "jobs/"+jobs["Running"][0].ID+"/cancel", "secret", nil); status != http.StatusOK {
+		t.Errorf("Status of cancelling the job: %d", status)
+	}
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "Cancelled" {
+			t.Errorf("Judge of a cancelled job returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The job was not cancelled")
+	}
+	if status := admin(t, h, "POST", "jobs/none/cancel", "secret", nil); status != http.StatusNotFound {
+		t.Errorf("Status of an unknown job: %d", status)
+	}
+}
+
+func TestAdminSubmissions(t *testing.T) {
+	h := start(t)
+	defer h.Close()
+	h.Server.AdminToken = "secret"
+	addWorker(t, h, sumJudge, 0)
+	if status := admin(t, h, "GET", "submissions", "secret", nil); status != http.StatusNotFound {
+		t.Errorf("Status without a store: %d", status)
+	}
+	defer os.RemoveAll(openStore(t, h))
+	if _, _, err := h.Judge(server.Submission{ProblemID: "sum", User: "ana", Data: []byte("ok")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []server.Record
+	if admin(t, h, "GET", "submissions?user=ana", "secret", &recs); len(recs) != 1 {
+		t.Fatalf("Submissions of 'ana': %+v", recs)
+	}
+	if admin(t, h, "GET", "submissions?user=bob", "secret", &recs); len(recs) != 0 {
+		t.Errorf("Submissions of 'bob': %+v", recs)
+	}
+	if status := admin(t, h, "GET", "submissions?from=yesterday", "secret", nil); status != http.StatusBadRequest {
+		t.Errorf("Status of a bad date: %d", status)
+	}
+	var rec server.Record
+	if admin(t, h, "GET", "submissions/1", "secret", &rec); rec.Verdict == nil || rec.Verdict.Status != server.Accepted {
+		t.Errorf("Submission '1': %+v", rec)
+	}
+	if status := admin(t, h, "GET", "submissions/1000", "secret", nil); status != http.StatusNotFound {
+		t.Errorf("Status of an unknown submission: %d", status)
+	}
+
+	var task server.RejudgeTask
+	if status := admin(t, h, "POST", "rejudge?problem=sum", "secret", &task); status != http.StatusOK {
+		t.Fatalf("Status of starting a rejudge: %d", status)
+	}
+	for deadline := time.Now().Add(10 * time.Second); !task.Done; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Rejudge '%s' did not finish", task.ID)
+		}
+		admin(t, h, "GET", "rejudge/"+task.ID, "secret", &task)
+	}
+	if len(task.Results) != 1 || task.Results[0].Changed {
+		t.Errorf("Results of the rejudge: %+v", task.Results)
+	}
+	if status := admin(t, h, "GET", "rejudge/1000", "secret", nil); status != http.StatusNotFound {
+		t.Errorf("Status of an unknown rejudge: %d", status)
+	}
+	if status := admin(t, h, "POST", "rejudge/1000/cancel", "secret", nil); status != http.StatusNotFound {
+		t.Errorf("Status of cancelling an unknown rejudge: %d", status)
+	}
+}
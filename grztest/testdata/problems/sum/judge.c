@@ -0,0 +1,3 @@
+/* The judge of the tests of grztest: the Fake sandbox does not compile
+   nor run it, its Judge function gives the verdict. */
+int main() { return 0; }
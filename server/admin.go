@@ -0,0 +1,264 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The admin API (under /admin/) lets whoever runs the server see what
+// the workers are doing and fix things by hand:
+//
+//   GET  /admin/workers                  list of WorkerInfo
+//   POST /admin/workers/<id>/drain       stop giving jobs to a worker
+//   POST /admin/workers/<id>/resume      give jobs to a worker again
+//   POST /admin/workers/<id>/disconnect  close the connection to a worker
+//   GET  /admin/jobs                     queued and running jobs (JobInfo)
+//   POST /admin/jobs/<id>/cancel         cancel a job
+//   GET  /admin/submissions              stored submissions (Record), which
+//                                        can be filtered with 'problem',
+//                                        'user', 'from' and 'to' (RFC 3339)
+//   GET  /admin/submissions/<id>         one stored submission
+//   POST /admin/rejudge?problem=<id>     start judging stored submissions
+//                                        again (same filters as above),
+//                                        returns a RejudgeTask
+//   GET  /admin/rejudge/<id>             the RejudgeTask, with the list of
+//                                        RejudgeResult when it is Done
+//   POST /admin/rejudge/<id>/cancel      stop a rejudge
+//
+// Requests must have an "Authorization: Bearer <AdminToken>" header.
+
+type WorkerInfo struct {
+	ID           string
+	Addr         string
+	Capabilities Capabilities
+	Since        time.Time
+	CurrentJob   string `json:",omitempty"`
+	Completed    int
+	Failures     int
+	Draining     bool
+	LastSeen     time.Time
+	Status       WorkerStatus // of the last pong
+}
+
+type JobInfo struct {
+	ID        string
+	ProblemID string
+	Created   time.Time
+	Attempts  int
+	Worker    string `json:",omitempty"`
+}
+
+func jobInfo(j *Job) JobInfo {
+	return JobInfo{ID: j.id, ProblemID: j.ProblemID, Created: j.created, Attempts: j.attempts}
+}
+
+// Workers returns the workers connected to the server.
+func (s *Server) Workers() (infos []WorkerInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.workers {
+		info := WorkerInfo{
+			ID:           w.id,
+			Addr:         w.addr,
+			Capabilities: w.caps,
+			Since:        w.since,
+			Completed:    w.completed,
+			Failures:     w.failures,
+			Draining:     atomic.LoadInt32(&w.draining) == 1,
+			LastSeen:     w.lastSeen,
+			Status:       w.status,
+		}
+		if w.current != nil {
+			info.CurrentJob = w.current.id
+		}
+		infos = append(infos, info)
+	}
+	return
+}
+
+func (s *Server) findWorker(id string) *worker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.workers {
+		if w.id == id {
+			return w
+		}
+	}
+	return nil
+}
+
+// findJob looks for a job among the queued and running ones.
+func (s *Server) findJob(id string) *Job {
+	for _, j := range s.jobs.list() {
+		if j.id == id {
+			return j
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.workers {
+		if w.current != nil && w.current.id == id {
+			return w.current
+		}
+	}
+	return nil
+}
+
+func (s *Server) jobsInfo() (queued, running []JobInfo) {
+	for _, j := range s.jobs.list() {
+		queued = append(queued, jobInfo(j))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.workers {
+		if w.current != nil {
+			info := jobInfo(w.current)
+			info.Worker = w.id
+			running = append(running, info)
+		}
+	}
+	return
+}
+
+func parseQuery(req *http.Request) (q Query, err error) {
+	values := req.URL.Query()
+	q.ProblemID = values.Get("problem")
+	q.User = values.Get("user")
+	if from := values.Get("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, err
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+func (s *Server) authorized(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Admin: cannot encode reply: %s", err)
+	}
+}
+
+// AdminHandler returns the handler of the admin API, which expects to
+// be installed at "/admin/".
+func (s *Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.AdminToken == "" {
+			http.Error(w, "Admin API disabled", http.StatusForbidden)
+			return
+		}
+		if !s.authorized(req) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/"), "/")
+		parts := strings.Split(path, "/")
+
+		switch {
+		case path == "workers" && req.Method == "GET":
+			writeJSON(w, s.Workers())
+
+		case path == "jobs" && req.Method == "GET":
+			queued, running := s.jobsInfo()
+			writeJSON(w, map[string][]JobInfo{"Queued": queued, "Running": running})
+
+		case parts[0] == "submissions" && s.Store == nil:
+			http.Error(w, "No submission store", http.StatusNotFound)
+
+		case path == "submissions" && req.Method == "GET":
+			q, err := parseQuery(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, s.Store.Find(q))
+
+		case len(parts) == 2 && parts[0] == "submissions" && req.Method == "GET":
+			rec, ok := s.Store.Get(parts[1])
+			if !ok {
+				http.Error(w, "Submission not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, rec)
+
+		case path == "rejudge" && req.Method == "POST":
+			q, err := parseQuery(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			id, err := s.StartRejudge(q)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			task, _ := s.RejudgeStatus(id)
+			writeJSON(w, task)
+
+		case len(parts) == 2 && parts[0] == "rejudge" && req.Method == "GET":
+			task, ok := s.RejudgeStatus(parts[1])
+			if !ok {
+				http.Error(w, "Rejudge not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, task)
+
+		case len(parts) == 3 && parts[0] == "rejudge" && parts[2] == "cancel" && req.Method == "POST":
+			if !s.CancelRejudge(parts[1]) {
+				http.Error(w, "Rejudge not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Admin: cancel rejudge %s", parts[1])
+			writeJSON(w, "ok")
+
+		case len(parts) == 3 && parts[0] == "workers" && req.Method == "POST":
+			wk := s.findWorker(parts[1])
+			if wk == nil {
+				http.Error(w, "Worker not found", http.StatusNotFound)
+				return
+			}
+			switch parts[2] {
+			case "drain":
+				atomic.StoreInt32(&wk.draining, 1)
+			case "resume":
+				atomic.StoreInt32(&wk.draining, 0)
+			case "disconnect":
+				wk.ws.Close()
+			default:
+				http.Error(w, "Unknown action", http.StatusNotFound)
+				return
+			}
+			log.Printf("Admin: %s worker %s [%s]", parts[2], wk.id, wk.addr)
+			writeJSON(w, "ok")
+
+		case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "cancel" && req.Method == "POST":
+			j := s.findJob(parts[1])
+			if j == nil {
+				http.Error(w, "Job not found", http.StatusNotFound)
+				return
+			}
+			j.abandon()
+			s.jobs.remove(j)
+			log.Printf("Admin: cancel job %s", j.id)
+			writeJSON(w, "ok")
+
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package server
+
+import "strings"
+
+// Capabilities describe what a worker can do. They are sent in the
+// hello message.
+type Capabilities struct {
+	Image     string            // VM image
+	Languages []string          // e.g. "c", "c++", "go", "python"
+	Versions  map[string]string `json:",omitempty"` // of each language
+	Arch      string            // architecture of the VM (e.g. "i386")
+	Labels    []string          // anything else
+}
+
+// Requirements are what a problem needs from a worker (they are part of
+// its Manifest). Empty fields mean anything will do.
+type Requirements struct {
+	Image     string   `json:",omitempty"`
+	Languages []string `json:",omitempty"`
+	Arch      string   `json:",omitempty"`
+	Labels    []string `json:",omitempty"`
+}
+
+func containsFold(list []string, s string) bool {
+	for _, x := range list {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Satisfies tells whether a worker with capabilities c can evaluate a
+// problem with requirements r.
+func (c Capabilities) Satisfies(r Requirements) bool {
+	if r.Image != "" && r.Image != c.Image {
+		return false
+	}
+	if r.Arch != "" && r.Arch != c.Arch {
+		return false
+	}
+	for _, lang := range r.Languages {
+		if !containsFold(c.Languages, lang) {
+			return false
+		}
+	}
+	for _, label := range r.Labels {
+		if !containsFold(c.Labels, label) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package server
+
+import "testing"
+
+func TestSatisfies(t *testing.T) {
+	caps := Capabilities{
+		Image:     "garzon.qcow2",
+		Languages: []string{"c", "c++", "Python"},
+		Arch:      "i386",
+		Labels:    []string{"gpu"},
+	}
+	tests := []struct {
+		r    Requirements
+		want bool
+	}{
+		{Requirements{}, true},
+		{Requirements{Image: "garzon.qcow2", Arch: "i386"}, true},
+		{Requirements{Image: "other.qcow2"}, false},
+		{Requirements{Arch: "amd64"}, false},
+		{Requirements{Languages: []string{"C++", "python"}}, true},
+		{Requirements{Languages: []string{"c", "go"}}, false},
+		{Requirements{Labels: []string{"GPU"}}, true},
+		{Requirements{Labels: []string{"gpu", "big"}}, false},
+	}
+	for _, test := range tests {
+		if got := caps.Satisfies(test.r); got != test.want {
+			t.Errorf("Satisfies(%+v) = %v, want %v", test.r, got, test.want)
+		}
+	}
+}
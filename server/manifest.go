@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Judge types
+const (
+	CustomJudge      = "custom"      // the problem has a 'judge.*' program
+	StandardJudge    = "standard"    // the solution is run on 'tests/*.in' and compared with '*.out'
+	InteractiveJudge = "interactive" // the solution talks with an interactor for each 'tests/*.in'
+)
+
+// Checker types (for the standard judge)
+const (
+	ExactChecker      = "exact"      // byte by byte
+	TokensChecker     = "tokens"     // words separated by any whitespace
+	WhitespaceChecker = "whitespace" // lines, ignoring spaces at both ends and repeated
+	CaseChecker       = "case"       // words, ignoring case
+	FloatChecker      = "float"      // words, numbers within AbsError or RelError
+	LinesChecker      = "lines"      // lines, in any order
+	ProgramChecker    = "program"    // 'Program' decides
+)
+
+// A Checker says how the standard judge compares the output of a
+// solution with the expected one. A checker program is a source file in
+// the problem directory, compiled in the VM, which is run with the
+// input, expected output and output files as arguments. It exits with 0
+// if the output is right, 1 if it is wrong (or anything else if it
+// fails), and what it prints is the message for the test.
+type Checker struct {
+	Type     string  `json:",omitempty"` // default: ExactChecker
+	AbsError float64 `json:",omitempty"` // for FloatChecker (default 1e-6)
+	RelError float64 `json:",omitempty"` // for FloatChecker (default 1e-6)
+	Program  string  `json:",omitempty"` // for ProgramChecker, e.g. "checker.cc"
+}
+
+var checkerTypes = map[string]bool{
+	ExactChecker:      true,
+	TokensChecker:     true,
+	WhitespaceChecker: true,
+	CaseChecker:       true,
+	FloatChecker:      true,
+	LinesChecker:      true,
+	ProgramChecker:    true,
+}
+
+// A Manifest describes a problem. It is read from the 'problem.json'
+// file in the problem directory, e.g.:
+//
+//	{
+//	  "Title": "Sum of two numbers",
+//	  "TimeLimit": 1.5,
+//	  "MemoryLimit": 64,
+//	  "Languages": ["c", "c++"],
+//	  "Judge": "standard",
+//	  "Checker": {"Type": "float", "AbsError": 1e-4},
+//	  "Requires": {"Labels": ["gmp"]}
+//	}
+//
+// Problems without manifest get the defaults.
+type Manifest struct {
+	Title               string
+	TimeLimit           float64      `json:",omitempty"` // CPU seconds (0 = no limit)
+	WallTimeLimit       float64      `json:",omitempty"` // seconds (0 = default)
+	MemoryLimit         int          `json:",omitempty"` // megabytes (0 = no limit)
+	OutputLimit         int          `json:",omitempty"` // megabytes (0 = default)
+	ProcessLimit        int          `json:",omitempty"` // processes of the solution (0 = default)
+	Languages           []string     `json:",omitempty"` // allowed for solutions (none = any)
+	Judge               string       // judge type (default: CustomJudge)
+	Checker             Checker      // for StandardJudge
+	Interactor          string       `json:",omitempty"` // for InteractiveJudge, e.g. "interactor.cc"
+	InteractorTimeLimit float64      `json:",omitempty"` // seconds (0 = no limit)
+	Requires            Requirements // what workers need
+	Hidden              bool         `json:",omitempty"` // not listed
+}
+
+const ManifestFile = "problem.json"
+
+var judgeTypes = map[string]bool{
+	CustomJudge:      true,
+	StandardJudge:    true,
+	InteractiveJudge: true,
+}
+
+// HasManifest tells if a directory is a problem with a manifest.
+func HasManifest(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ManifestFile))
+	return err == nil
+}
+
+// ReadManifest reads the manifest of the problem in dir, filling in
+// the defaults.
+func ReadManifest(dir string) (m Manifest, err error) {
+	filename := filepath.Join(dir, ManifestFile)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return m, fmt.Errorf("Cannot read '%s': %s", filename, err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return m, fmt.Errorf("Cannot parse '%s': %s", filename, err)
+		}
+	}
+	if m.Title == "" {
+		m.Title = filepath.Base(dir)
+	}
+	if m.Judge == "" {
+		m.Judge = CustomJudge
+	}
+	if !judgeTypes[m.Judge] {
+		return m, fmt.Errorf("%s: unknown judge type '%s'", filename, m.Judge)
+	}
+	if m.TimeLimit < 0 || m.WallTimeLimit < 0 || m.MemoryLimit < 0 ||
+		m.OutputLimit < 0 || m.ProcessLimit < 0 || m.InteractorTimeLimit < 0 {
+		return m, fmt.Errorf("%s: negative limits", filename)
+	}
+	if m.Judge == InteractiveJudge {
+		if err := checkProgram(dir, m.Interactor); err != nil {
+			return m, fmt.Errorf("%s: interactor: %s", filename, err)
+		}
+	}
+	if err := m.Checker.check(dir); err != nil {
+		return m, fmt.Errorf("%s: %s", filename, err)
+	}
+	return m, nil
+}
+
+// check fills in the defaults of a checker and validates it.
+func (c *Checker) check(dir string) error {
+	if c.Type == "" {
+		c.Type = ExactChecker
+	}
+	if !checkerTypes[c.Type] {
+		return fmt.Errorf("unknown checker type '%s'", c.Type)
+	}
+	if c.AbsError < 0 || c.RelError < 0 {
+		return fmt.Errorf("negative checker tolerance")
+	}
+	if c.Type == FloatChecker && c.AbsError == 0 && c.RelError == 0 {
+		c.AbsError, c.RelError = 1e-6, 1e-6
+	}
+	if c.Type == ProgramChecker {
+		if err := checkProgram(dir, c.Program); err != nil {
+			return fmt.Errorf("checker: %s", err)
+		}
+	}
+	return nil
+}
+
+// checkProgram checks that a program of a problem (a source file that
+// the worker compiles) is in its directory.
+func checkProgram(dir, program string) error {
+	if program == "" || filepath.Base(program) != program {
+		return fmt.Errorf("invalid program '%s'", program)
+	}
+	if _, err := os.Stat(filepath.Join(dir, program)); err != nil {
+		return fmt.Errorf("program '%s' not found", program)
+	}
+	return nil
+}
+
+// Language of the solutions to standard and interactive problems that do
+// not say theirs, if the manifest does not list any.
+const DefaultLanguage = "c++"
+
+// SolutionLanguage returns the language in which a solution in lang is
+// compiled: if lang is empty, the first language of the manifest (or
+// DefaultLanguage), except for custom judges, which may take solutions
+// as they are.
+func (m Manifest) SolutionLanguage(lang string) string {
+	switch {
+	case lang != "" || m.Judge == CustomJudge:
+		return lang
+	case len(m.Languages) > 0:
+		return m.Languages[0]
+	}
+	return DefaultLanguage
+}
+
+// AllowsLanguage tells if solutions in a language are accepted.
+func (m Manifest) AllowsLanguage(lang string) bool {
+	return len(m.Languages) == 0 || lang == "" || containsFold(m.Languages, lang)
+}
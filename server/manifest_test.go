@@ -0,0 +1,27 @@
+package server
+
+import "testing"
+
+func TestSolutionLanguage(t *testing.T) {
+	tests := []struct {
+		manifest Manifest
+		lang     string
+		want     string
+	}{
+		{Manifest{Judge: StandardJudge}, "go", "go"},
+		{Manifest{Judge: StandardJudge}, "", DefaultLanguage},
+		{Manifest{Judge: StandardJudge, Languages: []string{"python", "c"}}, "", "python"},
+		{Manifest{Judge: InteractiveJudge, Languages: []string{"c"}}, "", "c"},
+		{Manifest{Judge: CustomJudge, Languages: []string{"python"}}, "", ""},
+		{Manifest{Judge: CustomJudge}, "c", "c"},
+	}
+	for _, test := range tests {
+		lang := test.manifest.SolutionLanguage(test.lang)
+		if lang != test.want {
+			t.Errorf("SolutionLanguage(%q) of %+v = %q, want %q", test.lang, test.manifest, lang, test.want)
+		}
+		if !test.manifest.AllowsLanguage(lang) {
+			t.Errorf("%+v does not allow %q", test.manifest, lang)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bounds (in seconds) of the judge latency histogram buckets.
+var latencyBuckets = []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300}
+
+// metrics are the counters exposed in /metrics (the gauges are computed
+// when needed).
+type metrics struct {
+	mu                sync.Mutex
+	inFlight          int
+	verdicts          map[Status]int64
+	latencyCounts     []int64 // one per bucket, not cumulative
+	latencySum        float64
+	latencyCount      int64
+	transferredBytes  int64
+	workerDisconnects int64
+	heartbeatTimeouts int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		verdicts:      make(map[Status]int64),
+		latencyCounts: make([]int64, len(latencyBuckets)),
+	}
+}
+
+func (m *metrics) jobStarted() {
+	m.mu.Lock()
+	m.inFlight++
+	m.mu.Unlock()
+}
+
+func (m *metrics) jobFinished() {
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+}
+
+func (m *metrics) verdict(status Status) {
+	m.mu.Lock()
+	m.verdicts[status]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) latency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secs := d.Seconds()
+	m.latencySum += secs
+	m.latencyCount++
+	for i, bound := range latencyBuckets {
+		if secs <= bound {
+			m.latencyCounts[i]++
+			break
+		}
+	}
+}
+
+func (m *metrics) transferred(nbytes int) {
+	m.mu.Lock()
+	m.transferredBytes += int64(nbytes)
+	m.mu.Unlock()
+}
+
+func (m *metrics) disconnect() {
+	m.mu.Lock()
+	m.workerDisconnects++
+	m.mu.Unlock()
+}
+
+func (m *metrics) heartbeatTimeout() {
+	m.mu.Lock()
+	m.heartbeatTimeouts++
+	m.mu.Unlock()
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	workers, _ := s.countWorkers(Requirements{})
+	queued := s.jobs.len()
+
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetric(w, "garzon_workers_connected", "gauge",
+		"Number of workers connected.", workers)
+	writeMetric(w, "garzon_queue_depth", "gauge",
+		"Number of jobs waiting for a worker.", queued)
+	writeMetric(w, "garzon_jobs_in_flight", "gauge",
+		"Number of jobs being evaluated by workers.", m.inFlight)
+
+	fmt.Fprintf(w, "# HELP garzon_verdicts_total Number of verdicts by status.\n")
+	fmt.Fprintf(w, "# TYPE garzon_verdicts_total counter\n")
+	var statuses []string
+	for status := range m.verdicts {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "garzon_verdicts_total{status=%q} %d\n", status, m.verdicts[Status(status)])
+	}
+
+	fmt.Fprintf(w, "# HELP garzon_judge_duration_seconds Time from submission to verdict.\n")
+	fmt.Fprintf(w, "# TYPE garzon_judge_duration_seconds histogram\n")
+	var cumulative int64
+	for i, bound := range latencyBuckets {
+		cumulative += m.latencyCounts[i]
+		fmt.Fprintf(w, "garzon_judge_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "garzon_judge_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+	fmt.Fprintf(w, "garzon_judge_duration_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(w, "garzon_judge_duration_seconds_count %d\n", m.latencyCount)
+
+	writeMetric(w, "garzon_problem_transfer_bytes_total", "counter",
+		"Bytes of problems sent to workers.", m.transferredBytes)
+	writeMetric(w, "garzon_worker_disconnects_total", "counter",
+		"Number of workers that disconnected or died.", m.workerDisconnects)
+	writeMetric(w, "garzon_worker_heartbeat_timeouts_total", "counter",
+		"Number of workers given up for dead after missing pings.", m.heartbeatTimeouts)
+	writeMetric(w, "garzon_workers_rejected_total", "counter",
+		"Number of workers rejected in the handshake.", s.rejected())
+}
+
+// MetricsHandler returns a handler that shows the server's metrics in
+// the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func isDir(dir string) bool {
+	if info, err := os.Stat(dir); err == nil {
+		return info.IsDir()
+	}
+	return false
+}
+
+// findProblem returns the directory of a problem in one of the roots of
+// path, or "" if it is not found (or id points outside the roots).
+func findProblem(path, id string) (dir string) {
+	id = filepath.Clean(filepath.FromSlash(id))
+	if id == "." || id == ".." || filepath.IsAbs(id) || strings.HasPrefix(id, ".."+string(filepath.Separator)) {
+		return "" // outside the roots
+	}
+	for _, root := range filepath.SplitList(path) {
+		dir = filepath.Join(root, id)
+		if isDir(dir) {
+			return
+		}
+	}
+	return ""
+}
+
+// stampProblem computes a hash of the names, sizes, permissions and
+// modification times of the files in a problem directory, to know if it
+// has changed without reading the files.
+func stampProblem(dir string) (stamp string, err error) {
+	h := sha1.New()
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d %o %d\n", path, info.Size(), info.Mode(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Cannot read '%s': %s", dir, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// packProblem creates a tar.gz with the contents of a problem
+// directory. The same files always produce the same bytes: entries are
+// sorted, and times, owners and permissions (except the executable bit)
+// are not stored. It fails if the package is bigger than
+// maxPackageBytes.
+func packProblem(dir string) (targz []byte, err error) {
+	buf := limitedBuffer{max: maxPackageBytes}
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(zw)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			ModTime: time.Unix(0, 0),
+			Mode:    0644,
+			Format:  tar.FormatPAX,
+		}
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			hdr.Typeflag, hdr.Name, hdr.Mode = tar.TypeDir, hdr.Name+"/", 0755
+		case mode&os.ModeSymlink != 0:
+			hdr.Typeflag, hdr.Mode = tar.TypeSymlink, 0777
+			if hdr.Linkname, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			hdr.Typeflag, hdr.Size = tar.TypeReg, info.Size()
+			if mode&0111 != 0 {
+				hdr.Mode = 0755
+			}
+		default:
+			return nil // sockets, devices, ...
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.CopyN(tw, file, hdr.Size)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot pack '%s': %s", dir, err)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("Cannot pack '%s': %s", dir, err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("Cannot pack '%s': %s", dir, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Biggest package of a problem sent to the workers.
+const maxPackageBytes = 256 << 20
+
+// limitedBuffer is a bytes.Buffer that fails when it grows past max.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, fmt.Errorf("The package is bigger than %d bytes", b.max)
+	}
+	return b.Buffer.Write(p)
+}
+
+// HashPackage computes the hash that identifies a packed problem.
+func HashPackage(targz []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(targz))
+}
+
+// Packed problems are kept in memory (up to maxPackedBytes) and packed
+// again only when their directory changes.
+const maxPackedBytes = 512 << 20
+
+type packedProblem struct {
+	stamp    string
+	targz    []byte
+	hash     string
+	lastUsed time.Time
+}
+
+type packageCache struct {
+	mu       sync.Mutex
+	problems map[string]*packedProblem // by directory
+	size     int64
+}
+
+func newPackageCache() *packageCache {
+	return &packageCache{problems: make(map[string]*packedProblem)}
+}
+
+// get returns the package of a problem and its hash.
+func (c *packageCache) get(dir string) (targz []byte, hash string, err error) {
+	stamp, err := stampProblem(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	c.mu.Lock()
+	if p, ok := c.problems[dir]; ok && p.stamp == stamp {
+		p.lastUsed = time.Now()
+		c.mu.Unlock()
+		return p.targz, p.hash, nil
+	}
+	c.mu.Unlock()
+
+	if targz, err = packProblem(dir); err != nil {
+		return nil, "", err
+	}
+	p := &packedProblem{stamp, targz, HashPackage(targz), time.Now()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.problems[dir]; ok {
+		c.size -= int64(len(old.targz))
+	}
+	c.problems[dir] = p
+	c.size += int64(len(targz))
+	c.evict()
+	return p.targz, p.hash, nil
+}
+
+// evict removes the least recently used packages until they fit in
+// maxPackedBytes.
+func (c *packageCache) evict() {
+	for c.size > maxPackedBytes && len(c.problems) > 1 {
+		var oldest string
+		for dir, p := range c.problems {
+			if oldest == "" || p.lastUsed.Before(c.problems[oldest].lastUsed) {
+				oldest = dir
+			}
+		}
+		c.size -= int64(len(c.problems[oldest].targz))
+		delete(c.problems, oldest)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeProblem(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPackProblemDeterministic(t *testing.T) {
+	root, err := ioutil.TempDir("", "problems")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"judge.c":         "int main() {}\n",
+		"tests/1.in":      "1 2\n",
+		"tests/1.out":     "3\n",
+		"tests/big/2.in":  "10 20\n",
+		"tests/big/2.cor": "30\n",
+		"problem.json":    `{"Title": "Sum"}`,
+	}
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	writeProblem(t, a, files)
+	writeProblem(t, b, files)
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(b, "judge.c"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(filepath.Join(b, "tests/1.in"), 0644)
+
+	targzA, err := packProblem(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targzB, err := packProblem(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(targzA, targzB) {
+		t.Errorf("Packages of the same files differ")
+	}
+	if HashPackage(targzA) != HashPackage(targzB) {
+		t.Errorf("Hashes of the same files differ")
+	}
+
+	writeProblem(t, b, map[string]string{"tests/1.out": "4\n"})
+	if targzB, err = packProblem(b); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(targzA, targzB) {
+		t.Errorf("Packages of different files are equal")
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	buf := limitedBuffer{max: 10}
+	if _, err := buf.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buf.Write([]byte("x")); err == nil {
+		t.Errorf("Writing past the limit did not fail")
+	}
+}
+
+func TestFindProblem(t *testing.T) {
+	root, err := ioutil.TempDir("", "problems")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	one, two := filepath.Join(root, "one"), filepath.Join(root, "two")
+	writeProblem(t, one, map[string]string{"sum/judge.c": ""})
+	writeProblem(t, two, map[string]string{"cat/max/judge.c": ""})
+	path := one + string(filepath.ListSeparator) + two
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"sum", filepath.Join(one, "sum")},
+		{"cat/max", filepath.Join(two, "cat/max")},
+		{"cat/../sum", filepath.Join(one, "sum")},
+		{"nothing", ""},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../two/cat", ""},
+		{"../../..", ""},
+		{two, ""},
+	}
+	for _, test := range tests {
+		if got := findProblem(path, test.id); got != test.want {
+			t.Errorf("findProblem(%q) = %q, want %q", test.id, got, test.want)
+		}
+	}
+}
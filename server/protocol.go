@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// ProtocolVersion is the version of the conversation between server and
+// workers. It must be increased with every incompatible change.
+const ProtocolVersion = 5
+
+// Message types
+const (
+	MsgHello       = "hello"        // worker -> server: first message (payload: Capabilities)
+	MsgChallenge   = "challenge"    // server -> worker (payload: nonce)
+	MsgAuth        = "auth"         // worker -> server (payload: Sign(secret, nonce))
+	MsgWelcome     = "welcome"      // server -> worker: handshake accepted
+	MsgReject      = "reject"       // server -> worker: handshake refused (payload: reason)
+	MsgPing        = "ping"         // server -> worker: heartbeat, also during a job
+	MsgPong        = "pong"         // worker -> server (payload: WorkerStatus)
+	MsgSubmit      = "submit"       // server -> worker (payload: Task)
+	MsgNeedProblem = "need-problem" // worker -> server
+	MsgReady       = "ready"        // worker -> server: has the problem, starting
+	MsgProblem     = "problem"      // server -> worker (payload: Problem)
+	MsgProgress    = "progress"     // worker -> server (payload: string)
+	MsgVerdict     = "verdict"      // worker -> server (payload: Verdict)
+	MsgCancel      = "cancel"       // server -> worker: stop the job (a verdict is still expected)
+)
+
+// WorkerStatus is what a worker reports in each heartbeat.
+type WorkerStatus struct {
+	Busy       bool
+	CurrentJob string  `json:",omitempty"`
+	Phase      string  `json:",omitempty"` // of the job (copy, compile, run)
+	Healthy    bool    // the VM has not passed the deadline of the phase
+	CacheSize  int     // problems in the cache
+	Load       float64 // load average of the machine (1 minute)
+}
+
+// Message is the envelope of everything sent through the /_new_worker
+// websocket.
+type Message struct {
+	Type    string
+	JobID   string `json:",omitempty"`
+	Version int
+	Payload json.RawMessage `json:",omitempty"`
+}
+
+// Decode unmarshals the payload of a message into v.
+func (m *Message) Decode(v interface{}) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("Cannot decode '%s' payload: %s", m.Type, err)
+	}
+	return nil
+}
+
+// NewMessage builds a message with an optional payload (which can be nil).
+func NewMessage(typ, jobID string, payload interface{}) (*Message, error) {
+	msg := &Message{Type: typ, JobID: jobID, Version: ProtocolVersion}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot encode '%s' payload: %s", typ, err)
+		}
+		msg.Payload = data
+	}
+	return msg, nil
+}
+
+// Send sends a message with an optional payload (which can be nil).
+func Send(ws *websocket.Conn, typ, jobID string, payload interface{}) error {
+	msg, err := NewMessage(typ, jobID, payload)
+	if err != nil {
+		return err
+	}
+	return websocket.JSON.Send(ws, msg)
+}
+
+// Receive waits for the next message.
+func Receive(ws *websocket.Conn) (msg *Message, err error) {
+	msg = &Message{}
+	if err = websocket.JSON.Receive(ws, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Expect receives the next message and checks that it has the given
+// type and job ID.
+func Expect(ws *websocket.Conn, typ, jobID string) (msg *Message, err error) {
+	if msg, err = Receive(ws); err != nil {
+		return nil, err
+	}
+	if msg.Type != typ || msg.JobID != jobID {
+		return nil, fmt.Errorf("Expected '%s' for job '%s', got '%s' for job '%s'",
+			typ, jobID, msg.Type, msg.JobID)
+	}
+	return msg, nil
+}
+
+// Sign computes the answer to an authentication challenge: the
+// HMAC-SHA256 of the nonce using the shared secret.
+func Sign(secret, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Cannot generate nonce: %s", err)
+	}
+	return fmt.Sprintf("%x", b), nil
+}
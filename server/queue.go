@@ -0,0 +1,98 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// queue holds the jobs waiting for a worker. Jobs are normally
+// appended at the back (but before low priority jobs), and a job whose
+// worker died is put back at the front so that it does not lose its
+// turn.
+type queue struct {
+	mu   sync.Mutex
+	jobs []*Job
+	wake chan bool // closed (and replaced) every time a job is added
+}
+
+func newQueue() *queue {
+	return &queue{wake: make(chan bool)}
+}
+
+func (q *queue) signal() {
+	close(q.wake)
+	q.wake = make(chan bool)
+}
+
+func (q *queue) push(j *Job) {
+	q.mu.Lock()
+	i := len(q.jobs)
+	if !j.lowPriority {
+		for i > 0 && q.jobs[i-1].lowPriority {
+			i--
+		}
+	}
+	q.jobs = append(q.jobs, nil)
+	copy(q.jobs[i+1:], q.jobs[i:])
+	q.jobs[i] = j
+	q.signal()
+	q.mu.Unlock()
+}
+
+func (q *queue) pushFront(j *Job) {
+	q.mu.Lock()
+	q.jobs = append([]*Job{j}, q.jobs...)
+	q.signal()
+	q.mu.Unlock()
+}
+
+// remove takes a job out of the queue and reports whether it was
+// still there (i.e. no worker has picked it up yet).
+func (q *queue) remove(j *Job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, k := range q.jobs {
+		if k == j {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pop waits for a job for which match returns true, for at most
+// 'timeout', and returns nil if none arrived.
+func (q *queue) pop(match func(*Job) bool, timeout time.Duration) *Job {
+	expired := time.After(timeout)
+	for {
+		q.mu.Lock()
+		for i, j := range q.jobs {
+			if match(j) {
+				q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+				q.mu.Unlock()
+				return j
+			}
+		}
+		wake := q.wake
+		q.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-expired:
+			return nil
+		}
+	}
+}
+
+// list returns a copy of the jobs in the queue.
+func (q *queue) list() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*Job(nil), q.jobs...)
+}
+
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueOrder(t *testing.T) {
+	q := newQueue()
+	a, b, c, low := newJob(Submission{}), newJob(Submission{}), newJob(Submission{}), newJob(Submission{})
+	low.lowPriority = true
+	q.push(a)
+	q.push(low)
+	q.push(b)      // before the low priority job
+	q.pushFront(c) // a requeued job
+	all := func(*Job) bool { return true }
+	for i, want := range []*Job{c, a, b, low} {
+		if got := q.pop(all, time.Second); got != want {
+			t.Fatalf("Job %d: got %v, want %v", i, got, want)
+		}
+	}
+	if q.len() != 0 {
+		t.Errorf("%d jobs left", q.len())
+	}
+}
+
+func TestQueueMatchAndRemove(t *testing.T) {
+	q := newQueue()
+	a, b := newJob(Submission{Language: "c"}), newJob(Submission{Language: "go"})
+	q.push(a)
+	q.push(b)
+	if got := q.pop(func(j *Job) bool { return j.Language == "go" }, time.Second); got != b {
+		t.Errorf("pop returned %v, want the 'go' job", got)
+	}
+	if !q.remove(a) {
+		t.Errorf("remove did not find a job in the queue")
+	}
+	if q.remove(a) {
+		t.Errorf("remove found a job twice")
+	}
+}
+
+func TestQueuePopWaits(t *testing.T) {
+	q := newQueue()
+	if j := q.pop(func(*Job) bool { return true }, 10*time.Millisecond); j != nil {
+		t.Fatalf("pop returned %v from an empty queue", j)
+	}
+	a := newJob(Submission{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.push(a)
+	}()
+	if j := q.pop(func(*Job) bool { return true }, time.Second); j != a {
+		t.Errorf("pop returned %v, want the job pushed meanwhile", j)
+	}
+}
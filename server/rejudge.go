@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// RejudgeResult compares the old and new verdicts of a submission.
+type RejudgeResult struct {
+	ID      string
+	User    string   `json:",omitempty"`
+	Old     *Verdict `json:",omitempty"`
+	New     *Verdict `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+	Changed bool
+}
+
+func sameVerdict(a, b *Verdict) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Status == b.Status && a.Score == b.Score
+}
+
+func (s *Server) checkRejudge(q Query) error {
+	if s.Store == nil {
+		return fmt.Errorf("No submission store")
+	}
+	if q.ProblemID == "" {
+		return fmt.Errorf("No problem to rejudge")
+	}
+	return nil
+}
+
+// Number of submissions that a Rejudge judges at the same time.
+const rejudgeWorkers = 4
+
+// Rejudge judges again the stored submissions of a problem (all of
+// them or those matching the rest of the query), with low priority. It
+// is used after fixing a judge or the tests of a problem. When ctx is
+// done, the submissions not judged yet get its error.
+func (s *Server) Rejudge(ctx context.Context, q Query) ([]RejudgeResult, error) {
+	if err := s.checkRejudge(q); err != nil {
+		return nil, err
+	}
+	recs := s.Store.Find(q)
+	log.Printf("Rejudging %d submissions of '%s'", len(recs), q.ProblemID)
+
+	results := make([]RejudgeResult, len(recs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < rejudgeWorkers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				rec, res := recs[i], &results[i]
+				res.ID, res.User, res.Old = rec.ID, rec.User, rec.Verdict
+				if err := ctx.Err(); err != nil {
+					res.Error = err.Error()
+					continue
+				}
+				verdict, err := s.judgeAndRecord(ctx, rec.Submission, nil, true)
+				if err != nil {
+					res.Error = err.Error()
+					continue
+				}
+				res.New = &verdict
+				res.Changed = !sameVerdict(res.Old, res.New)
+			}
+		}()
+	}
+	for i := range recs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	nchanged := 0
+	for _, res := range results {
+		if res.Changed {
+			nchanged++
+		}
+	}
+	log.Printf("Rejudged '%s': %d of %d verdicts changed", q.ProblemID, nchanged, len(results))
+	return results, nil
+}
+
+// A RejudgeTask is a Rejudge running in the background.
+type RejudgeTask struct {
+	ID       string
+	Query    Query
+	Started  time.Time
+	Finished time.Time `json:",omitempty"`
+	Done     bool
+	Results  []RejudgeResult `json:",omitempty"`
+	Error    string          `json:",omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// Finished tasks are forgotten after this time.
+const rejudgeKeep = 24 * time.Hour
+
+// StartRejudge starts a Rejudge that does not depend on who asked for it
+// (e.g. an HTTP request that can time out), and returns its ID for
+// RejudgeStatus and CancelRejudge.
+func (s *Server) StartRejudge(q Query) (id string, err error) {
+	if err := s.checkRejudge(q); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.rejudgesMu.Lock()
+	for id, t := range s.rejudges {
+		if t.Done && time.Since(t.Finished) > rejudgeKeep {
+			delete(s.rejudges, id)
+		}
+	}
+	s.lastRejudgeID++
+	task := &RejudgeTask{ID: fmt.Sprintf("%d", s.lastRejudgeID), Query: q, Started: time.Now(), cancel: cancel}
+	s.rejudges[task.ID] = task
+	s.rejudgesMu.Unlock()
+
+	go func() {
+		results, err := s.Rejudge(ctx, q)
+		cancel()
+		s.rejudgesMu.Lock()
+		defer s.rejudgesMu.Unlock()
+		task.Done, task.Finished, task.Results = true, time.Now(), results
+		if err != nil {
+			task.Error = err.Error()
+		}
+	}()
+	return task.ID, nil
+}
+
+// CancelRejudge stops a task started with StartRejudge: the jobs being
+// evaluated are cancelled, and the rest are not judged. It returns false
+// if there is no such task.
+func (s *Server) CancelRejudge(id string) bool {
+	s.rejudgesMu.Lock()
+	defer s.rejudgesMu.Unlock()
+	t, ok := s.rejudges[id]
+	if ok {
+		t.cancel()
+	}
+	return ok
+}
+
+// RejudgeStatus returns a copy of a task started with StartRejudge.
+func (s *Server) RejudgeStatus(id string) (task RejudgeTask, ok bool) {
+	s.rejudgesMu.Lock()
+	defer s.rejudgesMu.Unlock()
+	if t, ok := s.rejudges[id]; ok {
+		return *t, true
+	}
+	return task, false
+}
@@ -1,27 +1,91 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go.net/websocket"
 )
 
-var numWorkers int32 = 0
+// Server distributes submissions among the workers connected to it.
+type Server struct {
+	// ProblemPath is a list of directories where problems are found
+	// (separated like $PATH).
+	ProblemPath string
 
-var ProblemPath = "."
+	// MaxAttempts is the number of workers a job is given to before
+	// giving up on it (a job is handed to another worker when its
+	// worker dies during the evaluation).
+	MaxAttempts int
+
+	// WorkerSecret is shared with the workers, which have to prove they
+	// know it when connecting. If empty, workers are not authenticated.
+	WorkerSecret string
+
+	// AdminToken must be sent in the Authorization header ("Bearer
+	// <token>") to use the admin API, which is disabled if it is empty.
+	AdminToken string
+
+	// Store, if not nil, records every submission judged.
+	Store *Store
+
+	// QueueTimeout is how long a submission waits for a worker before
+	// giving up (each time it goes back to the queue). Workers are pinged every PingInterval (also while they
+	// evaluate a job), and are given up for dead when they have not said
+	// anything for MaxMissedPings intervals.
+	QueueTimeout   time.Duration
+	PingInterval   time.Duration
+	MaxMissedPings int
+
+	jobs            *queue
+	packages        *packageCache
+	mu              sync.Mutex // protects 'workers'
+	workers         map[*worker]bool
+	rejectedWorkers int32
+	metrics         *metrics
+
+	rejudgesMu    sync.Mutex // protects 'rejudges' and 'lastRejudgeID'
+	rejudges      map[string]*RejudgeTask
+	lastRejudgeID int64
+}
+
+func New(problemPath string) *Server {
+	return &Server{
+		ProblemPath:    problemPath,
+		MaxAttempts:    3,
+		QueueTimeout:   10 * time.Second,
+		PingInterval:   10 * time.Second,
+		MaxMissedPings: 3,
+		jobs:           newQueue(),
+		packages:       newPackageCache(),
+		workers:        make(map[*worker]bool),
+		metrics:        newMetrics(),
+		rejudges:       make(map[string]*RejudgeTask),
+	}
+}
+
+// The package functions (Handle, Judge and JudgeContext) use Default,
+// which Handle configures with these variables.
+var (
+	ProblemPath  = "."
+	MaxAttempts  = 3
+	WorkerSecret = ""
+	AdminToken   = ""
+	SubmStore    *Store
+	Default      = New(".")
+)
 
 type Submission struct {
+	ID        string `json:",omitempty"` // assigned by the Store
 	ProblemID string
 	Data      []byte
+	Language  string `json:",omitempty"`
+	User      string `json:",omitempty"` // who submitted it
 }
 
 type Problem struct {
@@ -29,153 +93,260 @@ type Problem struct {
 	Targz []byte
 }
 
+// Task is what the server sends to a worker to evaluate a submission.
+// ProblemHash identifies the contents of the problem (it is the
+// HashPackage of its tar.gz), so that workers only ask for problems they
+// do not have already.
+type Task struct {
+	Submission
+	ProblemHash string
+	Manifest    Manifest
+}
+
 type Job struct {
 	Submission
-	updates chan string
+	id       string
+	created  time.Time
+	dir      string // where the problem is
+	manifest Manifest
+	updates  chan *Message // progress messages and the verdict
+	cancel   chan bool     // closed when nobody waits for the job anymore
+	err      error         // set before closing 'updates' if the job failed
+	attempts int
+	requeued chan bool // when the job goes back to the queue (it waits again)
+
+	lowPriority bool
+	once        sync.Once
 }
 
-var jobs = make(chan *Job)
+var lastJobID int64
 
-func isDir(dir string) bool {
-	if info, err := os.Stat(dir); err == nil {
-		return info.IsDir()
+func newJob(subm Submission) *Job {
+	return &Job{
+		Submission: subm,
+		id:         fmt.Sprintf("%d", atomic.AddInt64(&lastJobID, 1)),
+		created:    time.Now(),
+		updates:    make(chan *Message),
+		cancel:     make(chan bool),
+		requeued:   make(chan bool, 1),
 	}
-	return false
 }
 
-func findProblem(id string) (dir string) {
-	for _, root := range filepath.SplitList(ProblemPath) {
-		dir = filepath.Join(root, id)
-		if isDir(dir) {
-			return
-		}
+func (job *Job) cancelled() bool {
+	select {
+	case <-job.cancel:
+		return true
+	default:
+		return false
 	}
-	return ""
 }
 
-func compressProblem(dir string) (targz []byte, err error) {
-	filename := filepath.Join(os.TempDir(), "problem.tar.gz")
-	err = exec.Command("tar", "-czf", filename, "-C", dir, ".").Run()
-	if err != nil {
-		return nil, fmt.Errorf("Cannot compress: %s", err)
-	}
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot open '%s': %s", filename, err)
-	}
-	targz, err = ioutil.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot read '%s': %s", filename, err)
-	}
-	file.Close()
-	// TODO: erase 'problem.tar.gz'
-	return
+// abandon marks a job as cancelled (if a worker is evaluating it,
+// handleJob tells the worker to stop).
+func (job *Job) abandon() {
+	job.once.Do(func() { close(job.cancel) })
 }
 
-func handleJob(ws *websocket.Conn, job *Job) error {
-	// Find problem
-	var dir string
-	if job.ProblemID != "" {
-		dir = findProblem(job.ProblemID)
-		if dir == "" {
-			msg := fmt.Sprintf("Problem '%s' not found", job.ProblemID)
-			job.updates <- fmt.Sprintf("ERROR: %s", msg)
-			close(job.updates)
-			return fmt.Errorf("%s", msg)
-		}
+// update passes a message to whoever waits for the job, if anyone.
+func (job *Job) update(msg *Message) {
+	select {
+	case job.updates <- msg:
+	case <-job.cancel:
 	}
+}
 
-	// Submit (+ Send tar.gz is necessary)
-	websocket.JSON.Send(ws, job.Submission)
-	var reply string
-	if err := websocket.JSON.Receive(ws, &reply); err != nil {
-		return err
+// requires returns what a worker needs to evaluate the job: what the
+// problem requires and the language of the submission.
+func (job *Job) requires() Requirements {
+	r := job.manifest.Requires
+	if job.Language != "" && !containsFold(r.Languages, job.Language) {
+		r.Languages = append(r.Languages[:len(r.Languages):len(r.Languages)], job.Language)
 	}
-	switch reply {
-	case "alive":
-		return nil
+	return r
+}
+
+// fail ends a job with an error for whoever is waiting for it.
+func (job *Job) fail(format string, a ...interface{}) {
+	job.err = fmt.Errorf(format, a...)
+	close(job.updates)
+}
+
+// Judge evaluates a submission with one of the workers, calling report
+// with the progress messages.
+func (s *Server) Judge(subm Submission, report func(msg string)) (verdict Verdict, err error) {
+	return s.JudgeContext(context.Background(), subm, report)
+}
+
+// JudgeContext is like Judge but gives up when ctx is done: the job is
+// removed from the queue or, if a worker is evaluating it, the worker is
+// told to stop.
+//
+// If the server has a Store, the submission is recorded with a new ID
+// (the ID of the submission is ignored: only Rejudge judges stored
+// submissions again).
+func (s *Server) JudgeContext(ctx context.Context, subm Submission, report func(msg string)) (verdict Verdict, err error) {
+	subm.ID = ""
+	return s.judgeAndRecord(ctx, subm, report, false)
+}
 
-	case "need targz":
-		targz, err := compressProblem(dir)
+// judgeAndRecord judges a submission and records it in the Store (if
+// any). When an already judged submission is judged again, its old
+// verdict is kept in the record's history (or kept as the verdict, if
+// the new evaluation fails).
+func (s *Server) judgeAndRecord(ctx context.Context, subm Submission, report func(msg string), lowPriority bool) (verdict Verdict, err error) {
+	if s.Store == nil {
+		return s.judge(ctx, subm, report, lowPriority)
+	}
+	rec, ok := s.Store.Get(subm.ID)
+	if !ok {
+		r, err := s.Store.Add(subm)
 		if err != nil {
-			return fmt.Errorf("Cannot send problem: %s", err)
+			return Verdict{Status: JudgeError}, err
 		}
-		websocket.JSON.Send(ws, Problem{Id: job.ProblemID, Targz: targz})
-		log.Printf(`Sent problem "%s"`, dir)
-
-	case "ok":
+		rec = *r
 	}
-	log.Printf(`Submitted: %s`, job.Submission.ProblemID)
-
-	// Wait for updates (& veredict)
-	var msg string
-	for {
-		if err := websocket.JSON.Receive(ws, &msg); err != nil {
-			job.updates <- fmt.Sprintf("Error receiving updates: %s", err)
-			close(job.updates)
-			break
+	var progress []string
+	verdict, err = s.judge(ctx, rec.Submission, func(msg string) {
+		progress = append(progress, msg)
+		if report != nil {
+			report(msg)
 		}
-
-		job.updates <- msg
-
-		if strings.HasPrefix(msg, "VEREDICT") ||
-			strings.HasPrefix(msg, "ERROR") {
-			close(job.updates)
-			break
+	}, lowPriority)
+	// (the record may have changed meanwhile, e.g. in another rejudge)
+	record := func(r *Record) {
+		switch {
+		case err == nil:
+			if r.Verdict != nil {
+				r.Previous = append(r.Previous, *r.Verdict)
+			}
+			r.Verdict, r.Error = &verdict, ""
+			r.Progress, r.Judged = progress, time.Now()
+		case r.Verdict == nil:
+			r.Error = err.Error()
+			r.Progress, r.Judged = progress, time.Now()
+		default:
+			// A failed rejudge (cancelled, no workers...) keeps the verdict
+			r.Error = err.Error()
 		}
 	}
-	return nil
+	if err := s.Store.Modify(rec.ID, record); err != nil {
+		log.Printf("Cannot record verdict: %s", err)
+	}
+	return
 }
 
-func isAlive(ws *websocket.Conn) error {
-	return handleJob(ws, &Job{Submission{"", nil}, nil})
-}
+// judge puts a job in the queue and waits for its verdict. Low priority
+// jobs go after the others and can wait in the queue indefinitely.
+func (s *Server) judge(ctx context.Context, subm Submission, report func(msg string), lowPriority bool) (verdict Verdict, err error) {
+	newjob := newJob(subm)
+	newjob.lowPriority = lowPriority
+	if newjob.dir = findProblem(s.ProblemPath, subm.ProblemID); newjob.dir == "" {
+		return Verdict{Status: JudgeError}, fmt.Errorf("Problem '%s' not found", subm.ProblemID)
+	}
+	if newjob.manifest, err = ReadManifest(newjob.dir); err != nil {
+		return Verdict{Status: JudgeError}, err
+	}
+	// (routed and sent to the worker with the language it is compiled in)
+	subm.Language = newjob.manifest.SolutionLanguage(subm.Language)
+	newjob.Language = subm.Language
+	if !newjob.manifest.AllowsLanguage(subm.Language) {
+		return Verdict{Status: JudgeError}, fmt.Errorf("Language '%s' not allowed", subm.Language)
+	}
+	switch total, capable := s.countWorkers(newjob.requires()); {
+	case total == 0:
+		return Verdict{Status: JudgeError}, fmt.Errorf("No workers")
+	case capable == 0:
+		return Verdict{Status: JudgeError}, fmt.Errorf("No capable worker")
+	}
+	if report != nil {
+		report("In queue")
+	}
+	start := time.Now()
+	s.jobs.push(newjob)
 
-func newWorker(ws *websocket.Conn) {
-	atomic.AddInt32(&numWorkers, 1)
-	log.Printf("Connected [%s] (active = %d)\n", ws.RemoteAddr(), numWorkers)
+	var (
+		last    *Message
+		timeout <-chan time.Time
+	)
+	if !lowPriority {
+		timeout = time.After(s.QueueTimeout)
+	}
 	for {
 		select {
-		case j := <-jobs:
-			if err := handleJob(ws, j); err != nil {
-				log.Printf("Error handling job: %s", err)
-				// jobs <- j
+		case msg, ok := <-newjob.updates:
+			if !ok {
+				goto done
 			}
-		case <-time.After(10 * time.Second):
-			if err := isAlive(ws); err != nil {
-				ws.Close()
-				atomic.AddInt32(&numWorkers, -1)
-				log.Printf("Worker died (active = %d)", numWorkers)
-				return
+			last = msg
+			if msg.Type == MsgProgress && report != nil {
+				var text string
+				if err := msg.Decode(&text); err == nil {
+					report(text)
+				}
+			}
+
+		case <-timeout:
+			if s.jobs.remove(newjob) {
+				return Verdict{Status: JudgeError}, fmt.Errorf("No worker responding: try again later")
+			}
+
+		case <-newjob.requeued:
+			if !lowPriority {
+				timeout = time.After(s.QueueTimeout)
 			}
+
+		case <-ctx.Done():
+			newjob.abandon()
+			s.jobs.remove(newjob)
+			return Verdict{Status: JudgeError}, ctx.Err()
+
+		case <-newjob.cancel: // from the admin API
+			return Verdict{Status: JudgeError}, fmt.Errorf("Cancelled")
 		}
 	}
-}
-
-func Judge(subm Submission, report func(msg string)) (veredict string, err error) {
-	if numWorkers == 0 {
-		return "ERROR", fmt.Errorf("No workers")
+done:
+	if newjob.err != nil {
+		return Verdict{Status: JudgeError}, newjob.err
 	}
-	if report != nil {
-		report("In queue")
+	if last == nil || last.Type != MsgVerdict {
+		return Verdict{Status: JudgeError}, fmt.Errorf("No verdict received")
 	}
-	newjob := Job{subm, make(chan string)}
-	select {
-	case jobs <- &newjob:
-		var s string
-		for s = range newjob.updates {
-			if !strings.HasPrefix(s, "VEREDICT\n") && report != nil {
-				report(s)
-			}
-		}
-		veredict = s[len("VEREDICT\n"):]
+	if err := last.Decode(&verdict); err != nil {
+		return Verdict{Status: JudgeError}, err
+	}
+	s.metrics.latency(time.Since(start))
+	return verdict, nil
+}
 
-	case <-time.After(10 * time.Second):
-		return "ERROR", fmt.Errorf("No worker responding: try again later")
+// WorkerHandler returns the handler that accepts connections from
+// workers.
+func (s *Server) WorkerHandler() http.Handler {
+	if s.WorkerSecret == "" {
+		log.Printf("Warning: no WorkerSecret, workers are not authenticated")
 	}
-	return veredict, nil
+	return websocket.Handler(s.newWorker)
+}
+
+// Register installs the server's handlers in mux.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.Handle("/_new_worker", s.WorkerHandler())
+	mux.Handle("/metrics", s.MetricsHandler())
+	mux.Handle("/admin/", s.AdminHandler())
+}
+
+func Judge(subm Submission, report func(msg string)) (verdict Verdict, err error) {
+	return Default.Judge(subm, report)
+}
+
+func JudgeContext(ctx context.Context, subm Submission, report func(msg string)) (verdict Verdict, err error) {
+	return Default.JudgeContext(ctx, subm, report)
 }
 
 func Handle() {
-	http.Handle("/_new_worker", websocket.Handler(newWorker))
+	Default.ProblemPath = ProblemPath
+	Default.MaxAttempts = MaxAttempts
+	Default.WorkerSecret = WorkerSecret
+	Default.AdminToken = AdminToken
+	Default.Store = SubmStore
+	Default.Register(http.DefaultServeMux)
 }
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Record is everything known about a submission.
+type Record struct {
+	Submission
+	Submitted time.Time
+	Judged    time.Time `json:",omitempty"`
+	Verdict   *Verdict  `json:",omitempty"`
+	Error     string    `json:",omitempty"` // if it could not be judged
+	Progress  []string  `json:",omitempty"`
+	Previous  []Verdict `json:",omitempty"` // older verdicts (after a rejudge)
+}
+
+// Store keeps all submissions in a file ('submissions.jsonl') where
+// every change to a record is appended as a new line (and synced). When
+// opened, the file is read and the last version of each record is kept
+// in memory. An incomplete last line (from a crash while appending) is
+// removed, and so is the part written of a failed append.
+type Store struct {
+	mu      sync.Mutex
+	file    *os.File
+	size    int64 // of the file, after the last complete record
+	records map[string]*Record
+	lastID  int64
+}
+
+const storeFile = "submissions.jsonl"
+
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Cannot create '%s': %s", dir, err)
+	}
+	filename := filepath.Join(dir, storeFile)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open '%s': %s", filename, err)
+	}
+	st := &Store{file: file, records: make(map[string]*Record)}
+
+	reader := bufio.NewReader(file)
+	var offset int64 // of the current line
+	for nlin := 1; ; nlin++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// The last append was interrupted (every line ends in '\n')
+				log.Printf("%s:%d: removing incomplete record", filename, nlin)
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return nil, fmt.Errorf("Cannot truncate '%s': %s", filename, err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Cannot read '%s': %s", filename, err)
+		}
+		offset += int64(len(line))
+		rec := &Record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s:%d: %s", filename, nlin, err)
+		}
+		st.records[rec.ID] = rec
+		if n, err := strconv.ParseInt(rec.ID, 10, 64); err == nil && n > st.lastID {
+			st.lastID = n
+		}
+	}
+	st.size = offset
+	return st, nil
+}
+
+func (st *Store) Close() error {
+	return st.file.Close()
+}
+
+// write appends a record to the file. If it fails, the part written is
+// removed, so that the next records do not follow a broken line.
+func (st *Store) write(rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("Cannot encode record '%s': %s", rec.ID, err)
+	}
+	if _, err = st.file.Write(append(data, '\n')); err == nil {
+		err = st.file.Sync()
+	}
+	if err != nil {
+		if err := st.file.Truncate(st.size); err != nil {
+			log.Printf("Cannot truncate store: %s", err)
+		}
+		return fmt.Errorf("Cannot write record '%s': %s", rec.ID, err)
+	}
+	st.size += int64(len(data) + 1)
+	return nil
+}
+
+// Add records a new submission, assigning it an ID.
+func (st *Store) Add(subm Submission) (*Record, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	subm.ID = strconv.FormatInt(st.lastID+1, 10)
+	rec := &Record{Submission: subm, Submitted: time.Now()}
+	if err := st.write(rec); err != nil {
+		return nil, err
+	}
+	st.lastID++
+	st.records[rec.ID] = rec
+	return rec, nil
+}
+
+// Update saves a modified copy of a record.
+func (st *Store) Update(rec Record) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.records[rec.ID]; !ok {
+		return fmt.Errorf("Submission '%s' not found", rec.ID)
+	}
+	if err := st.write(&rec); err != nil {
+		return err
+	}
+	st.records[rec.ID] = &rec
+	return nil
+}
+
+// Modify changes a record with f and saves it. The store is locked
+// meanwhile, so that changes to the same record (e.g. of two rejudges)
+// are applied one after the other.
+func (st *Store) Modify(id string, f func(rec *Record)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	old, ok := st.records[id]
+	if !ok {
+		return fmt.Errorf("Submission '%s' not found", id)
+	}
+	rec := *old
+	rec.Previous = append([]Verdict(nil), old.Previous...)
+	f(&rec)
+	if err := st.write(&rec); err != nil {
+		return err
+	}
+	st.records[id] = &rec
+	return nil
+}
+
+// Get returns a copy of a record.
+func (st *Store) Get(id string) (rec Record, ok bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if r, ok := st.records[id]; ok {
+		return *r, true
+	}
+	return rec, false
+}
+
+// Query selects records. Empty fields match anything.
+type Query struct {
+	ProblemID string
+	User      string
+	From, To  time.Time // submission time
+}
+
+func (q Query) matches(rec *Record) bool {
+	return (q.ProblemID == "" || q.ProblemID == rec.ProblemID) &&
+		(q.User == "" || q.User == rec.User) &&
+		(q.From.IsZero() || !rec.Submitted.Before(q.From)) &&
+		(q.To.IsZero() || rec.Submitted.Before(q.To))
+}
+
+type bySubmitted []Record
+
+func (s bySubmitted) Len() int           { return len(s) }
+func (s bySubmitted) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySubmitted) Less(i, j int) bool { return s[i].Submitted.Before(s[j].Submitted) }
+
+// Find returns (copies of) the records that match a query, oldest first.
+func (st *Store) Find(q Query) (recs []Record) {
+	st.mu.Lock()
+	for _, rec := range st.records {
+		if q.matches(rec) {
+			recs = append(recs, *rec)
+		}
+	}
+	st.mu.Unlock()
+	sort.Sort(bySubmitted(recs))
+	return
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, err := st.Add(Submission{ProblemID: "sum", User: "ana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := st.Add(Submission{ProblemID: "max", User: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.ID == r2.ID {
+		t.Fatalf("Both submissions have ID '%s'", r1.ID)
+	}
+	rec := *r1
+	rec.Verdict = &Verdict{Status: Accepted, Score: 1}
+	if err := st.Update(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Update(Record{Submission: Submission{ID: "1000"}}); err == nil {
+		t.Errorf("Update of an unknown record did not fail")
+	}
+	if recs := st.Find(Query{User: "bob"}); len(recs) != 1 || recs[0].ID != r2.ID {
+		t.Errorf("Find(User: bob) = %+v", recs)
+	}
+	st.Close()
+
+	// Reopen, with an incomplete last line as if appending was cut short
+	filename := filepath.Join(dir, storeFile)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ID": "3", "Problem`)
+	f.Close()
+	if st, err = OpenStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := st.Get(r1.ID)
+	if !ok || got.Verdict == nil || got.Verdict.Status != Accepted {
+		t.Errorf("Record '%s' after reopening: %+v", r1.ID, got)
+	}
+	r3, err := st.Add(Submission{ProblemID: "sum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r3.ID == r1.ID || r3.ID == r2.ID {
+		t.Errorf("New record reuses ID '%s'", r3.ID)
+	}
+	st.Close()
+
+	// The incomplete line is gone: the file reads well again
+	if st, err = OpenStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if recs := st.Find(Query{}); len(recs) != 3 {
+		t.Errorf("%d records after reopening, want 3", len(recs))
+	}
+}
+
+func TestStoreFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := st.Add(Submission{ProblemID: "sum"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes fail while the file is read-only
+	file := st.file
+	if st.file, err = os.Open(filepath.Join(dir, storeFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Add(Submission{ProblemID: "sum"}); err == nil {
+		t.Fatalf("Add did not fail")
+	}
+	st.file.Close()
+	st.file = file
+
+	rec, err := st.Add(Submission{ProblemID: "sum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != "2" {
+		t.Errorf("ID after a failed Add is '%s', want '2'", rec.ID)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type Status string
+
+const (
+	Accepted     Status = "Accepted"
+	WrongAnswer  Status = "WrongAnswer"
+	TimeLimit    Status = "TimeLimit"
+	MemoryLimit  Status = "MemoryLimit"
+	OutputLimit  Status = "OutputLimit"
+	RuntimeError Status = "RuntimeError"
+	CompileError Status = "CompileError"
+	JudgeError   Status = "JudgeError"
+)
+
+var titles = map[Status]string{
+	Accepted:     "Accepted",
+	WrongAnswer:  "Wrong Answer",
+	TimeLimit:    "Time Limit Exceeded",
+	MemoryLimit:  "Memory Limit Exceeded",
+	OutputLimit:  "Output Limit Exceeded",
+	RuntimeError: "Runtime Error",
+	CompileError: "Compile Error",
+	JudgeError:   "Judge Error",
+}
+
+// Title returns the human readable name of a status.
+func (s Status) Title() string {
+	if t, ok := titles[s]; ok {
+		return t
+	}
+	return string(s)
+}
+
+type TestResult struct {
+	Name    string
+	Status  Status
+	Message string `json:",omitempty"`
+}
+
+// A Verdict is the result of judging a submission. Score goes from 0
+// (nothing right) to 1 (everything right).
+type Verdict struct {
+	Status  Status
+	Score   float64
+	Tests   []TestResult `json:",omitempty"`
+	Message string       `json:",omitempty"`
+}
+
+func (v Verdict) String() string {
+	s := v.Status.Title() + "\n"
+	for _, t := range v.Tests {
+		s += fmt.Sprintf("%s: %s\n", t.Name, t.Status.Title())
+		if t.Message != "" {
+			s += t.Message + "\n"
+		}
+	}
+	return s + v.Message
+}
+
+func parseStatus(title string) (Status, bool) {
+	title = strings.TrimSpace(title)
+	for status, t := range titles {
+		if strings.EqualFold(title, t) || strings.EqualFold(title, string(status)) {
+			return status, true
+		}
+	}
+	return "", false
+}
+
+// ParseVerdict interprets the output of a judge. Judges can print a
+// Verdict in JSON, or plain text where the first line is the status
+// ("Accepted", "Wrong Answer", ...) and the rest is the message.
+func ParseVerdict(output string) Verdict {
+	var v Verdict
+	if strings.HasPrefix(strings.TrimSpace(output), "{") {
+		if err := json.Unmarshal([]byte(output), &v); err == nil && v.Status != "" {
+			return v
+		}
+	}
+	first, rest := output, ""
+	if i := strings.Index(output, "\n"); i != -1 {
+		first, rest = output[:i], output[i+1:]
+	}
+	if status, ok := parseStatus(first); ok {
+		v = Verdict{Status: status, Message: rest}
+	} else {
+		// Unknown wording: the judge did not accept it
+		v = Verdict{Status: WrongAnswer, Message: output}
+	}
+	if v.Status == Accepted {
+		v.Score = 1
+	}
+	return v
+}
@@ -0,0 +1,25 @@
+package server
+
+import "testing"
+
+func TestParseVerdict(t *testing.T) {
+	tests := []struct {
+		output string
+		want   Verdict
+	}{
+		{"Accepted\n", Verdict{Status: Accepted, Score: 1}},
+		{"Wrong Answer\nTest 2 failed\n", Verdict{Status: WrongAnswer, Message: "Test 2 failed\n"}},
+		{"  time limit exceeded \n", Verdict{Status: TimeLimit}},
+		{"RuntimeError", Verdict{Status: RuntimeError}},
+		{"Yes!\n", Verdict{Status: WrongAnswer, Message: "Yes!\n"}},
+		{`{"Status": "Accepted", "Score": 0.5}`, Verdict{Status: Accepted, Score: 0.5}},
+		{`{"Status": "WrongAnswer", "Message": "Bad"}`, Verdict{Status: WrongAnswer, Message: "Bad"}},
+		{`{"Score": 1}`, Verdict{Status: WrongAnswer, Message: `{"Score": 1}`}},
+	}
+	for _, test := range tests {
+		got := ParseVerdict(test.output)
+		if got.Status != test.want.Status || got.Score != test.want.Score || got.Message != test.want.Message {
+			t.Errorf("ParseVerdict(%q) = %+v, want %+v", test.output, got, test.want)
+		}
+	}
+}
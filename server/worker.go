@@ -0,0 +1,357 @@
+package server
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// worker is a grz-worker connected to the server.
+type worker struct {
+	id       string
+	ws       *websocket.Conn
+	addr     string
+	since    time.Time
+	caps     Capabilities
+	draining int32 // if 1, the worker does not get new jobs
+
+	// Messages other than pongs, from readMessages, which closes it
+	// (after setting readErr) when the connection breaks.
+	incoming chan *Message
+	readErr  error
+
+	// protected by Server.mu
+	current   *Job
+	completed int
+	failures  int
+	lastSeen  time.Time
+	status    WorkerStatus
+}
+
+var lastWorkerID int64
+
+func (w *worker) canDo(j *Job) bool {
+	return atomic.LoadInt32(&w.draining) == 0 && w.caps.Satisfies(j.requires())
+}
+
+func (s *Server) addWorker(w *worker) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers[w] = true
+	return len(s.workers)
+}
+
+// setCurrent records the job a worker is evaluating (nil when it has
+// finished), and whether the previous one failed.
+func (s *Server) setCurrent(w *worker, j *Job, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w.current != nil {
+		if failed {
+			w.failures++
+		} else {
+			w.completed++
+		}
+	}
+	w.current = j
+}
+
+func (s *Server) removeWorker(w *worker) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.workers, w)
+	return len(s.workers)
+}
+
+func (s *Server) rejected() int32 {
+	return atomic.LoadInt32(&s.rejectedWorkers)
+}
+
+// countWorkers returns the number of workers, and how many of them
+// satisfy some requirements.
+func (s *Server) countWorkers(r Requirements) (total, capable int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.workers {
+		if w.caps.Satisfies(r) {
+			capable++
+		}
+	}
+	return len(s.workers), capable
+}
+
+// receive returns the next message of a worker (other than a pong).
+func (w *worker) receive() (*Message, error) {
+	msg, ok := <-w.incoming
+	if !ok {
+		return nil, w.readErr
+	}
+	return msg, nil
+}
+
+// readMessages receives the messages of a worker while it is connected,
+// recording when it was last seen and the status in its pongs.
+func (s *Server) readMessages(w *worker) {
+	defer close(w.incoming)
+	for {
+		msg, err := Receive(w.ws)
+		if err != nil {
+			w.readErr = err
+			return
+		}
+		var status WorkerStatus
+		if msg.Type == MsgPong {
+			if err := msg.Decode(&status); err != nil {
+				log.Printf("Worker %s: %s", w.id, err)
+			}
+		}
+		s.mu.Lock()
+		w.lastSeen = time.Now()
+		if msg.Type == MsgPong {
+			w.status = status
+		}
+		s.mu.Unlock()
+		if msg.Type != MsgPong {
+			w.incoming <- msg
+		}
+	}
+}
+
+// heartbeat pings a worker every PingInterval, also while it evaluates a
+// job, and closes the connection if the worker has not said anything for
+// MaxMissedPings intervals (a busy worker still answers pings, a hung
+// one does not), until done is closed.
+func (s *Server) heartbeat(w *worker, done chan bool) {
+	ticker := time.NewTicker(s.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		s.mu.Lock()
+		silent := time.Since(w.lastSeen)
+		s.mu.Unlock()
+		if silent > time.Duration(s.MaxMissedPings)*s.PingInterval {
+			log.Printf("Worker %s missed %d pings (silent for %s)", w.id, s.MaxMissedPings, silent)
+			s.metrics.heartbeatTimeout()
+			w.ws.Close()
+			return
+		}
+		if err := Send(w.ws, MsgPing, "", nil); err != nil {
+			w.ws.Close()
+			return
+		}
+	}
+}
+
+// handleJob sends a job to a worker and relays its updates. It returns
+// an error only when the conversation with the worker breaks, in which
+// case the job is left unfinished so that it can be requeued.
+func (s *Server) handleJob(w *worker, job *Job) error {
+	ws := w.ws
+	if job.cancelled() {
+		return nil
+	}
+	s.metrics.jobStarted()
+	defer s.metrics.jobFinished()
+
+	dir := job.dir
+	targz, hash, err := s.packages.get(dir)
+	if err != nil {
+		job.fail("%s", err)
+		log.Printf("%s", err)
+		return nil
+	}
+
+	// Submit (+ Send tar.gz is necessary)
+	if err := Send(ws, MsgSubmit, job.id, Task{job.Submission, hash, job.manifest}); err != nil {
+		return err
+	}
+
+	// Tell the worker to stop if the job is cancelled meanwhile
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-job.cancel:
+			log.Printf("Cancelling job %s", job.id)
+			Send(ws, MsgCancel, job.id, nil)
+		case <-finished:
+		}
+	}()
+
+	reply, err := w.receive()
+	if err != nil {
+		return err
+	}
+	if reply.JobID != job.id {
+		return fmt.Errorf("Reply for job '%s' while submitting job '%s'", reply.JobID, job.id)
+	}
+	switch reply.Type {
+	case MsgNeedProblem:
+		err = Send(ws, MsgProblem, job.id, Problem{Id: job.ProblemID, Targz: targz})
+		if err != nil {
+			return err
+		}
+		s.metrics.transferred(len(targz))
+		log.Printf(`Sent problem "%s"`, dir)
+
+	case MsgReady:
+
+	default:
+		return fmt.Errorf("Unexpected '%s' reply to a submission", reply.Type)
+	}
+	log.Printf(`Submitted: %s (job %s)`, job.ProblemID, job.id)
+
+	// Wait for updates (& verdict)
+	for {
+		msg, err := w.receive()
+		if err != nil {
+			return fmt.Errorf("Error receiving updates: %s", err)
+		}
+		if msg.JobID != job.id {
+			return fmt.Errorf("Update for job '%s' while running job '%s'", msg.JobID, job.id)
+		}
+		switch msg.Type {
+		case MsgProgress:
+			job.update(msg)
+		case MsgVerdict:
+			var verdict Verdict
+			if err := msg.Decode(&verdict); err == nil {
+				s.metrics.verdict(verdict.Status)
+			}
+			job.update(msg)
+			close(job.updates)
+			return nil
+		default:
+			return fmt.Errorf("Unexpected '%s' message while running a job", msg.Type)
+		}
+	}
+}
+
+func reject(ws *websocket.Conn, reason string) error {
+	Send(ws, MsgReject, "", reason)
+	return fmt.Errorf("%s", reason)
+}
+
+// handshake checks that the worker speaks our version of the protocol
+// and, if there is a WorkerSecret, that it knows the secret. It returns
+// the capabilities of the worker.
+func (s *Server) handshake(ws *websocket.Conn) (caps Capabilities, err error) {
+	hello, err := Expect(ws, MsgHello, "")
+	if err != nil {
+		return caps, err
+	}
+	if hello.Version != ProtocolVersion {
+		return caps, reject(ws, fmt.Sprintf("Protocol version %d not supported (server has %d)",
+			hello.Version, ProtocolVersion))
+	}
+	if err := hello.Decode(&caps); err != nil {
+		return caps, reject(ws, err.Error())
+	}
+	if s.WorkerSecret != "" {
+		nonce, err := newNonce()
+		if err != nil {
+			return caps, reject(ws, err.Error())
+		}
+		if err := Send(ws, MsgChallenge, "", nonce); err != nil {
+			return caps, err
+		}
+		auth, err := Expect(ws, MsgAuth, "")
+		if err != nil {
+			return caps, err
+		}
+		var mac string
+		if err := auth.Decode(&mac); err != nil {
+			return caps, reject(ws, err.Error())
+		}
+		if !hmac.Equal([]byte(mac), []byte(Sign(s.WorkerSecret, nonce))) {
+			return caps, reject(ws, "Authentication failed")
+		}
+	}
+	return caps, Send(ws, MsgWelcome, "", nil)
+}
+
+// requeue puts a job whose worker died back at the front of the queue,
+// unless it has already been tried MaxAttempts times.
+func (s *Server) requeue(j *Job) {
+	if j.err != nil || j.cancelled() {
+		return // the job failed anyway, or nobody wants it
+	}
+	j.attempts++
+	if j.attempts >= s.MaxAttempts {
+		log.Printf("Giving up on job '%s' after %d attempts", j.ProblemID, j.attempts)
+		j.fail("Job failed after %d attempts", j.attempts)
+		return
+	}
+	log.Printf("Requeueing job '%s' (attempt %d)", j.ProblemID, j.attempts+1)
+	msg, _ := NewMessage(MsgProgress, j.id, "Worker lost, retrying...")
+	j.update(msg)
+	select {
+	case j.requeued <- true:
+	default: // (the last one has not been seen yet)
+	}
+	s.jobs.pushFront(j)
+}
+
+func (s *Server) newWorker(ws *websocket.Conn) {
+	caps, err := s.handshake(ws)
+	if err != nil {
+		n := atomic.AddInt32(&s.rejectedWorkers, 1)
+		log.Printf("Rejected worker [%s]: %s (rejected = %d)", ws.RemoteAddr(), err, n)
+		ws.Close()
+		return
+	}
+	now := time.Now()
+	w := &worker{
+		id:       fmt.Sprintf("%d", atomic.AddInt64(&lastWorkerID, 1)),
+		ws:       ws,
+		addr:     ws.RemoteAddr().String(),
+		since:    now,
+		caps:     caps,
+		incoming: make(chan *Message),
+		lastSeen: now,
+	}
+	n := s.addWorker(w)
+	log.Printf("Connected [%s] image '%s' %v (active = %d)\n", w.addr, caps.Image, caps.Languages, n)
+	done := make(chan bool)
+	go s.readMessages(w)
+	go s.heartbeat(w, done)
+	defer func() {
+		close(done)
+		ws.Close()
+		for range w.incoming {
+			// until readMessages stops
+		}
+		n := s.removeWorker(w)
+		s.metrics.disconnect()
+		log.Printf("Worker died (active = %d)", n)
+	}()
+	for {
+		// Between jobs the worker should only send pongs
+		select {
+		case msg, ok := <-w.incoming:
+			if ok {
+				log.Printf("Unexpected '%s' message from idle worker %s", msg.Type, w.id)
+			}
+			return
+		default:
+		}
+		if j := s.jobs.pop(w.canDo, s.PingInterval); j != nil {
+			s.setCurrent(w, j, false)
+			err := s.handleJob(w, j)
+			s.setCurrent(w, nil, err != nil || j.err != nil)
+			if err != nil {
+				log.Printf("Error handling job: %s", err)
+				s.requeue(j)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package worker
+
+import (
+	"fmt"
+	gsrv "garzon/server"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Problems received from the server are kept uncompressed in
+// '~/.grz/problems/<hash>'. The modification time of each directory is
+// the last time it was used, and when there are more than 'CacheSize'
+// problems the least recently used ones are removed. The slots of the
+// worker share the cache, so it is used with 'cacheMu' locked.
+
+func (w *Worker) ProblemsDir() string {
+	return filepath.Join(w.HomeDir, "problems")
+}
+
+func validHash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	for _, c := range hash {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// CachedProblem returns the directory of a problem in the cache, or ""
+// if it is not there.
+func (w *Worker) CachedProblem(hash string) string {
+	if !validHash(hash) {
+		return ""
+	}
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+	return w.cachedProblem(hash)
+}
+
+func (w *Worker) cachedProblem(hash string) string {
+	dir := filepath.Join(w.ProblemsDir(), hash)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		log.Printf("Cannot touch '%s': %s", dir, err)
+	}
+	return dir
+}
+
+// AddProblem checks that a problem matches the hash announced by the
+// server, uncompresses it into the cache and returns its directory.
+func (w *Worker) AddProblem(hash string, targz []byte) (dir string, err error) {
+	if !validHash(hash) {
+		return "", fmt.Errorf("Invalid problem hash '%s'", hash)
+	}
+	if h := gsrv.HashPackage(targz); h != hash {
+		return "", fmt.Errorf("Problem hash is '%s', expected '%s'", h, hash)
+	}
+
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+	if dir := w.cachedProblem(hash); dir != "" {
+		return dir, nil // another slot added it
+	}
+	dir = filepath.Join(w.ProblemsDir(), hash)
+	newdir := dir + ".new"
+	if err := ensureTempDir(newdir); err != nil {
+		return "", err
+	}
+	if err := Untar(targz, newdir); err != nil {
+		os.RemoveAll(newdir)
+		return "", fmt.Errorf("Cannot uncompress problem: %s", err)
+	}
+	os.RemoveAll(dir)
+	if err := os.Rename(newdir, dir); err != nil {
+		os.RemoveAll(newdir)
+		return "", fmt.Errorf("Cannot move '%s' into cache: %s", newdir, err)
+	}
+	log.Printf("Cached problem '%s'", hash)
+	w.pruneCache()
+	return dir, nil
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+
+// pruneCache removes the least recently used problems until there are
+// at most 'CacheSize'.
+func (w *Worker) pruneCache() {
+	list, err := ioutil.ReadDir(w.ProblemsDir())
+	if err != nil {
+		log.Printf("Cannot read cache: %s", err)
+		return
+	}
+	var problems []os.FileInfo
+	for _, info := range list {
+		if info.IsDir() && validHash(info.Name()) {
+			problems = append(problems, info)
+		}
+	}
+	sort.Sort(byModTime(problems))
+	for len(problems) > w.CacheSize {
+		dir := filepath.Join(w.ProblemsDir(), problems[0].Name())
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Cannot remove '%s': %s", dir, err)
+		}
+		log.Printf("Removed problem '%s' from cache", problems[0].Name())
+		problems = problems[1:]
+	}
+}
@@ -0,0 +1,108 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	gsrv "garzon/server"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Check compares the output of a solution with the expected one using
+// one of the built-in checkers. It returns whether the output is right
+// and a message saying where it is wrong.
+func Check(c gsrv.Checker, expected, output []byte) (ok bool, msg string) {
+	switch c.Type {
+	case gsrv.TokensChecker:
+		return checkTokens(expected, output, func(a, b string) bool { return a == b })
+	case gsrv.CaseChecker:
+		return checkTokens(expected, output, strings.EqualFold)
+	case gsrv.FloatChecker:
+		return checkTokens(expected, output, func(a, b string) bool {
+			return floatEqual(a, b, c.AbsError, c.RelError)
+		})
+	case gsrv.WhitespaceChecker:
+		return checkLines(normalizedLines(expected), normalizedLines(output))
+	case gsrv.LinesChecker:
+		exp, out := normalizedLines(expected), normalizedLines(output)
+		sort.Strings(exp)
+		sort.Strings(out)
+		if ok, _ := checkLines(exp, out); !ok {
+			return false, "The lines are not the expected ones"
+		}
+		return true, ""
+	}
+	return checkExact(expected, output)
+}
+
+func shorten(s string) string {
+	if len(s) > 40 {
+		return s[:37] + "..."
+	}
+	return s
+}
+
+func checkExact(expected, output []byte) (bool, string) {
+	if bytes.Equal(expected, output) {
+		return true, ""
+	}
+	return checkLines(strings.Split(string(expected), "\n"), strings.Split(string(output), "\n"))
+}
+
+func checkTokens(expected, output []byte, equal func(exp, out string) bool) (bool, string) {
+	exp := strings.Fields(string(expected))
+	out := strings.Fields(string(output))
+	for i := 0; i < len(exp) && i < len(out); i++ {
+		if !equal(exp[i], out[i]) {
+			return false, fmt.Sprintf("Word %d: expected '%s', got '%s'", i+1, shorten(exp[i]), shorten(out[i]))
+		}
+	}
+	switch {
+	case len(out) < len(exp):
+		return false, fmt.Sprintf("Expected %d words, got %d", len(exp), len(out))
+	case len(out) > len(exp):
+		return false, fmt.Sprintf("Expected %d words, got %d (extra '%s')", len(exp), len(out), shorten(out[len(exp)]))
+	}
+	return true, ""
+}
+
+// floatEqual compares two words as numbers if both are, and as strings
+// otherwise.
+func floatEqual(exp, out string, absError, relError float64) bool {
+	x, err1 := strconv.ParseFloat(exp, 64)
+	y, err2 := strconv.ParseFloat(out, 64)
+	if err1 != nil || err2 != nil {
+		return exp == out
+	}
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return math.IsNaN(x) && math.IsNaN(y)
+	}
+	diff := math.Abs(x - y)
+	return x == y || diff <= absError || diff <= relError*math.Abs(x)
+}
+
+// normalizedLines splits text in lines, removing repeated spaces, spaces
+// at both ends and empty lines at the end.
+func normalizedLines(text []byte) (lines []string) {
+	for _, line := range strings.Split(string(text), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return
+}
+
+func checkLines(exp, out []string) (bool, string) {
+	for i := 0; i < len(exp) && i < len(out); i++ {
+		if exp[i] != out[i] {
+			return false, fmt.Sprintf("Line %d: expected '%s', got '%s'", i+1, shorten(exp[i]), shorten(out[i]))
+		}
+	}
+	if len(exp) != len(out) {
+		return false, fmt.Sprintf("Expected %d lines, got %d", len(exp), len(out))
+	}
+	return true, ""
+}
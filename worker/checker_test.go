@@ -0,0 +1,65 @@
+package worker
+
+import (
+	gsrv "garzon/server"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	float := gsrv.Checker{Type: gsrv.FloatChecker, AbsError: 1e-6, RelError: 1e-6}
+	tests := []struct {
+		checker          gsrv.Checker
+		expected, output string
+		ok               bool
+	}{
+		{gsrv.Checker{}, "1 2\n3\n", "1 2\n3\n", true},
+		{gsrv.Checker{}, "1 2\n3\n", "1 2\n3", false},
+		{gsrv.Checker{}, "1 2\n", "1  2\n", false},
+		{gsrv.Checker{Type: gsrv.TokensChecker}, "1 2\n3\n", " 1\n2 3", true},
+		{gsrv.Checker{Type: gsrv.TokensChecker}, "1 2 3", "1 2", false},
+		{gsrv.Checker{Type: gsrv.TokensChecker}, "1 2", "1 2 3", false},
+		{gsrv.Checker{Type: gsrv.CaseChecker}, "YES no", "yes NO", true},
+		{gsrv.Checker{Type: gsrv.CaseChecker}, "yes", "yess", false},
+		{gsrv.Checker{Type: gsrv.WhitespaceChecker}, "a  b\nc\n", " a b \nc\n\n\n", true},
+		{gsrv.Checker{Type: gsrv.WhitespaceChecker}, "a b\nc\n", "a b c\n", false},
+		{gsrv.Checker{Type: gsrv.LinesChecker}, "a\nb\nc\n", "c\na\nb\n", true},
+		{gsrv.Checker{Type: gsrv.LinesChecker}, "a\nb\n", "a\na\n", false},
+		{float, "3.1415926 x", "3.14159265 x", true},
+		{float, "3.14159", "3.1416", false},
+		{float, "1e10", "10000000001", true},
+		{float, "nan", "NaN", true},
+		{float, "1", "one", false},
+	}
+	for _, test := range tests {
+		ok, msg := Check(test.checker, []byte(test.expected), []byte(test.output))
+		if ok != test.ok {
+			t.Errorf("Check(%q, %q, %q) = %v (%s), want %v", test.checker.Type, test.expected, test.output, ok, msg, test.ok)
+		}
+		if !ok && msg == "" {
+			t.Errorf("Check(%q, %q, %q) gives no message", test.checker.Type, test.expected, test.output)
+		}
+	}
+}
+
+func TestFloatEqual(t *testing.T) {
+	tests := []struct {
+		exp, out         string
+		absError, relErr float64
+		want             bool
+	}{
+		{"1.0", "1", 0, 0, true},
+		{"1.0", "1.001", 0.01, 0, true},
+		{"1.0", "1.001", 0.0001, 0, false},
+		{"1000", "1001", 0, 0.01, true},
+		{"1000", "1001", 0, 0.0001, false},
+		{"inf", "+Inf", 0, 0, true},
+		{"nan", "1", 1, 1, false},
+		{"abc", "abc", 0, 0, true},
+		{"abc", "1", 1, 1, false},
+	}
+	for _, test := range tests {
+		if got := floatEqual(test.exp, test.out, test.absError, test.relErr); got != test.want {
+			t.Errorf("floatEqual(%q, %q, %g, %g) = %v, want %v", test.exp, test.out, test.absError, test.relErr, got, test.want)
+		}
+	}
+}
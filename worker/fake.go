@@ -0,0 +1,186 @@
+package worker
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Fake sandbox runs nothing, to test the server and the worker without
+// VMs. Commands do nothing and succeed (so solutions always compile), and
+// the judge of the problem ('garzon.sh') is replaced by the Judge
+// function, so it only makes sense with custom judges.
+type Fake struct {
+	// Judge returns what the judge reports for a solution (the progress
+	// messages) and what it prints (the verdict, see gsrv.ParseVerdict).
+	Judge func(solution []byte) (progress []string, output string)
+
+	// Delay is how long the judge takes for each progress message and
+	// for the verdict, so that jobs can be cancelled or time out.
+	Delay time.Duration
+
+	cdrom    string
+	deadline time.Time
+	stuck    bool
+
+	mu          sync.Mutex // protects 'interrupted' and 'wake'
+	interrupted bool
+	wake        chan bool // closed by Interrupt
+}
+
+// NewFake returns a Fake sandbox with a judge (nil accepts everything).
+func NewFake(judge func(solution []byte) (progress []string, output string)) *Fake {
+	if judge == nil {
+		judge = func([]byte) ([]string, string) { return nil, "Accepted\n" }
+	}
+	return &Fake{Judge: judge, wake: make(chan bool)}
+}
+
+func (F *Fake) StartAndReset() error { return nil }
+func (F *Fake) Reset()               {}
+func (F *Fake) Quit() error          { return nil }
+func (F *Fake) Kill()                {}
+
+func (F *Fake) SetDeadline(t time.Time) {
+	F.deadline = t
+}
+
+func (F *Fake) Stuck() bool {
+	return F.stuck
+}
+
+func (F *Fake) Recover() error {
+	F.stuck = false
+	return nil
+}
+
+// Shell answers the exit status of commands (0) and nothing else.
+func (F *Fake) Shell(cmd string) string {
+	if F.stuck {
+		return ""
+	}
+	if strings.HasSuffix(cmd, "echo $?") {
+		return "0\n"
+	}
+	return ""
+}
+
+// ShellReport runs 'garzon.sh' with the Judge (waiting Delay before each
+// line but the hashes), and other commands with Shell.
+func (F *Fake) ShellReport(cmd string, report func(string)) string {
+	if F.Interrupted() {
+		return ""
+	}
+	if cmd != "garzon.sh" {
+		return F.Shell(cmd)
+	}
+	solution, err := ioutil.ReadFile(filepath.Join(F.cdrom, "solution"))
+	if err != nil {
+		return ""
+	}
+	hash := fmt.Sprintf("%x", sha1.Sum(solution))
+	progress, verdict := F.Judge(solution)
+
+	var output string
+	emit := func(line string) {
+		output += line + "\n"
+		if report != nil {
+			report(line)
+		}
+	}
+	emit(hash)
+	for _, msg := range progress {
+		if !F.wait() {
+			return output
+		}
+		emit(msg)
+	}
+	if !F.wait() {
+		return output
+	}
+	emit(hash)
+	for _, line := range strings.Split(strings.TrimSuffix(verdict, "\n"), "\n") {
+		emit(line)
+	}
+	return output
+}
+
+// wait waits for Delay, and returns false if the sandbox is interrupted
+// or gets stuck meanwhile.
+func (F *Fake) wait() bool {
+	if F.stuck {
+		return false
+	}
+	var timeout <-chan time.Time
+	if !F.deadline.IsZero() {
+		timeout = time.After(F.deadline.Sub(time.Now()))
+	}
+	F.mu.Lock()
+	wake := F.wake
+	F.mu.Unlock()
+	select {
+	case <-time.After(F.Delay):
+		return true
+	case <-wake:
+	case <-timeout:
+		F.stuck = true
+	}
+	return false
+}
+
+func (F *Fake) Interrupt() {
+	F.mu.Lock()
+	defer F.mu.Unlock()
+	if !F.interrupted {
+		F.interrupted = true
+		close(F.wake)
+	}
+}
+
+func (F *Fake) Interrupted() bool {
+	F.mu.Lock()
+	defer F.mu.Unlock()
+	return F.interrupted
+}
+
+func (F *Fake) ClearInterrupt() {
+	F.mu.Lock()
+	defer F.mu.Unlock()
+	if F.interrupted {
+		F.interrupted = false
+		F.wake = make(chan bool)
+	}
+}
+
+func (F *Fake) CopyToGuest(guestfile, hostfile string) error {
+	if F.stuck {
+		return fmt.Errorf("Fake.CopyToGuest: timeout")
+	}
+	return nil
+}
+
+// CopyToHost creates an empty executable (like a compiled judge).
+func (F *Fake) CopyToHost(hostfile, guestfile string) error {
+	if F.stuck {
+		return fmt.Errorf("Fake.CopyToHost: timeout")
+	}
+	return ioutil.WriteFile(hostfile, nil, 0700)
+}
+
+// Insert remembers dir, where the judge will find the solution.
+func (F *Fake) Insert(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("Fake.Insert: %s", err)
+	}
+	F.cdrom = dir
+	return nil
+}
+
+func (F *Fake) Eject() {
+	F.cdrom = ""
+}
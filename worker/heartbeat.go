@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"fmt"
+	gsrv "garzon/server"
+	"io/ioutil"
+	"time"
+)
+
+// The server pings each slot periodically, also while it evaluates a
+// job, and the slot answers with its status (readMessages does, so that
+// a busy slot answers at once). A slot whose sandbox is past the deadline
+// of a phase is not healthy until the job ends.
+
+func (s *Slot) setCurrentJob(id string) {
+	s.currentJob.Lock()
+	s.currentJob.id = id
+	s.currentJob.phase, s.currentJob.deadline = "", time.Time{}
+	s.currentJob.Unlock()
+}
+
+func (s *Slot) setPhase(phase string, deadline time.Time) {
+	s.currentJob.Lock()
+	s.currentJob.phase, s.currentJob.deadline = phase, deadline
+	s.currentJob.Unlock()
+}
+
+// Status returns what the slot reports in its pongs.
+func (s *Slot) Status() gsrv.WorkerStatus {
+	s.currentJob.Lock()
+	status := gsrv.WorkerStatus{
+		Busy:       s.currentJob.id != "",
+		CurrentJob: s.currentJob.id,
+		Phase:      s.currentJob.phase,
+		Healthy:    s.currentJob.deadline.IsZero() || time.Now().Before(s.currentJob.deadline),
+	}
+	s.currentJob.Unlock()
+	status.CacheSize = s.w.CachedProblems()
+	status.Load = loadAverage()
+	return status
+}
+
+// CachedProblems returns the number of problems in the cache.
+func (w *Worker) CachedProblems() (n int) {
+	list, err := ioutil.ReadDir(w.ProblemsDir())
+	if err != nil {
+		return 0
+	}
+	for _, info := range list {
+		if info.IsDir() && validHash(info.Name()) {
+			n++
+		}
+	}
+	return n
+}
+
+// loadAverage returns the load average of the last minute (0 if it is
+// not known).
+func loadAverage() (load float64) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fmt.Sscan(string(data), &load)
+	return load
+}
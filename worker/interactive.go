@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"fmt"
+	gsrv "garzon/server"
+	"log"
+	"strings"
+)
+
+// In interactive problems the solution and the interactor of the problem
+// run at the same time, each one reading what the other writes (through
+// two fifos in '/tmp/run'). The interactor receives the input of the test
+// as argument, and decides like a checker program: it exits with 0 if the
+// solution is right, 1 if it is wrong, and what it prints on stderr is
+// the message for the test.
+
+// EvalInteractive evaluates a solution with the interactor and tests of a
+// problem, which must be in the CD-ROM.
+func (s *Slot) EvalInteractive(problemDir string, manifest gsrv.Manifest, language string, report func(msg string)) (verdict gsrv.Verdict, err error) {
+	tests, err := findTests(problemDir, false)
+	if err != nil {
+		return verdict, err
+	}
+	limits := SolutionLimits(manifest)
+	interactorLimits := Limits{CPU: seconds(manifest.InteractorTimeLimit), Wall: limits.Wall}
+	return s.evalTests(tests, language, manifest.Interactor, func(test testCase, solution, interactor string) (gsrv.TestResult, error) {
+		return s.runInteractive(test, limits.Command(solution), interactorLimits.Command(interactor))
+	}, report)
+}
+
+// runInteractive runs the solution (as user 'garzon') and the interactor
+// for a test (the commands include the limits).
+func (s *Slot) runInteractive(test testCase, solution, interactor string) (result gsrv.TestResult, err error) {
+	result.Name = test.name
+	s.copyInput(test)
+	// (the solution has its own wall time limit: if this hangs, it is
+	// the interactor's fault)
+	s.startPhase("interact", s.w.RunTimeout)
+	// (all in one line, the shell of the VM is interactive)
+	cmd := "cd /tmp/run && rm -f to-sol from-sol solution.status solution.err; " +
+		"mkfifo to-sol from-sol && chown garzon to-sol from-sol || exit 100; " +
+		fmt.Sprintf(`(su garzon -c "cd /tmp/run && exec %s < to-sol > from-sol" 2>solution.err; echo $? > solution.status) & `, solution) +
+		fmt.Sprintf("%s input > to-sol < from-sol; ", interactor) +
+		"s=$?; wait; exit $s"
+	status, output, err := s.runInVM(cmd)
+	if err != nil {
+		return result, err
+	}
+	result.Message = strings.TrimSpace(output)
+	var solStatus int
+	if _, err := fmt.Sscan(s.box.Shell("cat /tmp/run/solution.status"), &solStatus); err != nil {
+		return result, fmt.Errorf("Cannot get exit status of the solution: %s", err)
+	}
+	// (its error output tells if it ran out of memory)
+	solStderr := s.box.Shell("head -c 10000 /tmp/run/solution.err")
+
+	switch status {
+	case 0:
+		result.Status = gsrv.Accepted
+		if solStatus != 0 {
+			result.Status, result.Message = Classify(solStatus, solStderr)
+		}
+	case 1:
+		result.Status = gsrv.WrongAnswer
+		if st, msg := Classify(solStatus, solStderr); st == gsrv.TimeLimit || st == gsrv.MemoryLimit {
+			result.Status, result.Message = st, msg // the interactor got tired of waiting (or the solution died)
+		}
+	default:
+		if st, msg := Classify(status, ""); st == gsrv.TimeLimit {
+			return result, fmt.Errorf("Interactor: %s", msg)
+		}
+		return result, fmt.Errorf("Interactor failed with status %d: %s", status, result.Message)
+	}
+	log.Printf("Test '%s': %s", test.name, result.Status)
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// A Language says how to compile and run programs in the VM. In the
+// commands, '{src}' is the source file (with the first extension of the
+// language) and '{bin}' the compiled program.
+type Language struct {
+	Name       string
+	Extensions []string
+	Compile    string // empty if there is nothing to compile
+	Run        string
+	Version    string // prints the version of the compiler or interpreter
+}
+
+var Languages = []*Language{
+	{
+		Name:       "c",
+		Extensions: []string{".c"},
+		Compile:    "gcc -O2 -o {bin} {src} -lm",
+		Run:        "{bin}",
+		Version:    "gcc --version | head -n 1",
+	},
+	{
+		Name:       "c++",
+		Extensions: []string{".cc", ".cpp", ".cxx"},
+		Compile:    "g++ -O2 -o {bin} {src}",
+		Run:        "{bin}",
+		Version:    "g++ --version | head -n 1",
+	},
+	{
+		Name:       "go",
+		Extensions: []string{".go"},
+		Compile:    "go build -o {bin} {src}",
+		Run:        "{bin}",
+		Version:    "go version",
+	},
+	{
+		Name:       "python",
+		Extensions: []string{".py"},
+		Compile:    "python -m py_compile {src}",
+		Run:        "python {src}",
+		Version:    "python --version 2>&1",
+	},
+}
+
+// setupShell prepares the environment of the VM's shell for the
+// compilers (the Local sandbox uses those of the host).
+func (s *Slot) setupShell() {
+	s.box.Shell("[ -d /mnt/vda/go ] && export GOROOT=/mnt/vda/go PATH=$PATH:/mnt/vda/go/bin")
+}
+
+// FindLanguage returns the language with a name, or nil.
+func FindLanguage(name string) *Language {
+	for _, lang := range Languages {
+		if strings.EqualFold(lang.Name, name) {
+			return lang
+		}
+	}
+	return nil
+}
+
+// LanguageOf returns the language of a source file by its extension, or
+// nil.
+func LanguageOf(filename string) *Language {
+	ext := filepath.Ext(filename)
+	for _, lang := range Languages {
+		for _, e := range lang.Extensions {
+			if e == ext {
+				return lang
+			}
+		}
+	}
+	return nil
+}
+
+// Native tells if the compiled program can be run by itself.
+func (L *Language) Native() bool {
+	return L.Run == "{bin}"
+}
+
+func (L *Language) expand(cmd, bin string) string {
+	return strings.NewReplacer("{src}", L.Source(bin), "{bin}", bin).Replace(cmd)
+}
+
+// Source returns where the source of the program bin goes.
+func (L *Language) Source(bin string) string {
+	return bin + L.Extensions[0]
+}
+
+// CompileCommand returns the command that copies the source file src
+// and compiles it into bin (everything in the VM).
+func (L *Language) CompileCommand(src, bin string) string {
+	cmd := fmt.Sprintf("cp %s %s", src, L.Source(bin))
+	if L.Compile != "" {
+		cmd += " && " + L.expand(L.Compile, bin)
+	}
+	return cmd
+}
+
+// RunCommand returns the command that runs bin.
+func (L *Language) RunCommand(bin string) string {
+	return L.expand(L.Run, bin)
+}
+
+// LanguageVersions asks the VM for the version of each language.
+func (s *Slot) LanguageVersions(names []string) map[string]string {
+	s.setupShell()
+	defer s.box.Reset()
+	versions := make(map[string]string)
+	for _, name := range names {
+		lang := FindLanguage(name)
+		if lang == nil || lang.Version == "" {
+			continue
+		}
+		version := strings.TrimSpace(s.box.Shell(lang.Version))
+		log.Printf("Language '%s': %s", lang.Name, version)
+		versions[lang.Name] = version
+	}
+	return versions
+}
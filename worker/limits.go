@@ -0,0 +1,151 @@
+package worker
+
+import (
+	"fmt"
+	gsrv "garzon/server"
+	"io/ioutil"
+	"math"
+	"strings"
+	"syscall"
+)
+
+// Solutions are run with '/mnt/cdrom/run' (the script below, put in the
+// CD-ROM by PrepareCDROM), which applies the limits of the problem with
+// 'ulimit' and kills the program if it runs for too long. Custom judges
+// can also use it, it is '../run' for them.
+
+const runScript = `#!/bin/sh
+# Usage: run CPU WALL MEMORY OUTPUT PROCESSES COMMAND [ARGS...]
+# Runs COMMAND with limits (0 = no limit): CPU and wall time in seconds,
+# memory and output size in KB, and number of processes. Exits with
+# the status of COMMAND, or 124 if it ran for longer than WALL. (In the
+# local sandbox the processes of the user in the host count too, so
+# there is no limit on them.)
+cpu=$1 wall=$2 mem=$3 out=$4 procs=$5
+shift 5
+# (the stdin of a command run with '&' is /dev/null, so it goes by fd 3)
+exec 3<&0
+(
+  [ $cpu -gt 0 ] && ulimit -S -t $cpu && ulimit -H -t $(( cpu + 1 ))
+  [ $mem -gt 0 ] && ulimit -v $mem
+  [ $out -gt 0 ] && ulimit -f $(( out * 2 ))
+  [ $procs -gt 0 ] && [ "$GARZON_SANDBOX" != local ] && ulimit -p $(( procs + 3 ))
+  exec "$@" <&3 3<&-
+) &
+pid=$!
+exec 3<&-
+if [ $wall -gt 0 ]; then
+  # (once it kills the program, it exits with 99 even if killed)
+  ( sleep $wall; trap '' TERM; kill -9 $pid; exit 99 ) 2>/dev/null &
+  watchdog=$!
+fi
+wait $pid
+status=$?
+if [ -n "$watchdog" ]; then
+  kill $watchdog 2>/dev/null
+  wait $watchdog 2>/dev/null
+  [ $? -eq 99 ] && status=124
+fi
+# kill whatever the program left behind (not as root!)
+[ $(id -u) -ne 0 ] && kill -9 -1 2>/dev/null
+exit $status
+`
+
+// Exit status of the run script when the program is killed because of
+// the wall time.
+const wallTimeStatus = 124
+
+// Defaults for the limits with no "unlimited" value in the manifest.
+const (
+	defaultWallTime     = 60 // seconds, when there is no TimeLimit
+	defaultOutputLimit  = 64 // MB
+	defaultProcessLimit = 1
+)
+
+// WriteRunScript puts the run script in the directory of the CD-ROM.
+func (s *Slot) WriteRunScript() error {
+	if err := ioutil.WriteFile(s.Tmp("current/run"), []byte(runScript), 0755); err != nil {
+		return fmt.Errorf("Cannot write run script: %s", err)
+	}
+	return nil
+}
+
+// Limits are the limits for running a program, in the units of the run
+// script.
+type Limits struct {
+	CPU, Wall      int // seconds
+	Memory, Output int // KB
+	Processes      int
+}
+
+func seconds(s float64) int {
+	return int(math.Ceil(s))
+}
+
+// SolutionLimits returns the limits for the solution of a problem. The
+// CPU time limit is rounded up to whole seconds, and the wall time is,
+// by default, twice the CPU time plus one second.
+func SolutionLimits(m gsrv.Manifest) Limits {
+	l := Limits{
+		CPU:       seconds(m.TimeLimit),
+		Wall:      seconds(m.WallTimeLimit),
+		Memory:    m.MemoryLimit * 1024,
+		Output:    m.OutputLimit * 1024,
+		Processes: m.ProcessLimit,
+	}
+	if l.Wall == 0 {
+		l.Wall = defaultWallTime
+		if l.CPU > 0 {
+			l.Wall = 2*l.CPU + 1
+		}
+	}
+	if l.Output == 0 {
+		l.Output = defaultOutputLimit * 1024
+	}
+	if l.Processes == 0 {
+		l.Processes = defaultProcessLimit
+	}
+	return l
+}
+
+// Where the standard judge copies the run script (the CD-ROM is not
+// mounted while solutions run).
+const runScriptPath = "/tmp/bin/run"
+
+// Command returns the command that runs cmd with these limits.
+func (l Limits) Command(cmd string) string {
+	return fmt.Sprintf("%s %d %d %d %d %d %s", runScriptPath, l.CPU, l.Wall, l.Memory, l.Output, l.Processes, cmd)
+}
+
+// Signs of running out of memory in the error output of a program.
+var outOfMemory = []string{
+	"bad_alloc",
+	"out of memory",
+	"Cannot allocate memory",
+	"MemoryError",
+}
+
+// Classify tells why a program run with the run script ended, from its
+// exit status and error output.
+func Classify(status int, stderr string) (gsrv.Status, string) {
+	if status == 0 {
+		return gsrv.Accepted, ""
+	}
+	for _, sign := range outOfMemory {
+		if strings.Contains(stderr, sign) {
+			return gsrv.MemoryLimit, ""
+		}
+	}
+	switch {
+	case status == wallTimeStatus:
+		return gsrv.TimeLimit, "Wall time limit exceeded"
+	case status == 128+int(syscall.SIGXCPU):
+		return gsrv.TimeLimit, "CPU time limit exceeded"
+	case status == 128+int(syscall.SIGXFSZ):
+		return gsrv.OutputLimit, ""
+	case status > 128:
+		sig := syscall.Signal(status - 128)
+		return gsrv.RuntimeError, fmt.Sprintf("Killed by signal %d (%s)", int(sig), sig)
+	}
+	return gsrv.RuntimeError, fmt.Sprintf("Exit status %d", status)
+}
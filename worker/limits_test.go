@@ -0,0 +1,31 @@
+package worker
+
+import (
+	gsrv "garzon/server"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		status int
+		stderr string
+		want   gsrv.Status
+	}{
+		{0, "", gsrv.Accepted},
+		{0, "out of memory", gsrv.Accepted},
+		{1, "", gsrv.RuntimeError},
+		{134, "terminate called after throwing an instance of 'std::bad_alloc'", gsrv.MemoryLimit},
+		{1, "MemoryError", gsrv.MemoryLimit},
+		{wallTimeStatus, "", gsrv.TimeLimit},
+		{128 + int(syscall.SIGXCPU), "", gsrv.TimeLimit},
+		{128 + int(syscall.SIGKILL), "", gsrv.RuntimeError},
+		{128 + int(syscall.SIGSEGV), "", gsrv.RuntimeError},
+		{128 + int(syscall.SIGXFSZ), "", gsrv.OutputLimit},
+	}
+	for _, test := range tests {
+		if got, msg := Classify(test.status, test.stderr); got != test.want {
+			t.Errorf("Classify(%d, %q) = %s (%s), want %s", test.status, test.stderr, got, msg, test.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The Local sandbox runs the commands in the host, for machines that
+// cannot run KVM. The worker starts itself again (with SandboxInitArg) in
+// new user, mount, PID, network, IPC and UTS namespaces, where it makes
+// the layout of the VM and becomes a shell (see SandboxInit):
+//
+//	/mnt/cdrom   the CD-ROM, read-only ('<Dir>/cdrom' in the host)
+//	/mnt/io      to copy files ('<Dir>/io' in the host)
+//	/mnt/bin     garzon.sh and the commands below, first in the PATH
+//	/tmp, $HOME  empty
+//
+// There is only one user (root inside, the user of the worker outside),
+// so 'su garzon' just runs the command, and nothing protects the tests,
+// the run script or the checker from the solution: the Local sandbox is
+// only for trusted solutions. Reset starts a new shell, in new
+// namespaces.
+type Local struct {
+	Dir string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	buf    []byte
+	fresh  bool
+	stuck  bool
+
+	mu          sync.Mutex // protects 'cmd', 'running' and 'interrupted'
+	running     bool       // ShellReport is waiting for a command
+	interrupted bool
+}
+
+// Commands that stand in for those of the VM in '/mnt/bin'.
+var localCommands = map[string]string{
+	"garzon.sh": `#!/bin/sh
+# Like '/bin/garzon.sh' in the VM (the CD-ROM is always mounted)
+shash=$(sha1sum /mnt/cdrom/solution | cut -d' ' -f1)
+cd /mnt/cdrom/problem
+echo $shash
+../judge < ../solution > /tmp/output-$shash
+echo $shash
+cat /tmp/output-$shash
+rm -f /tmp/output-$shash
+`,
+	"su": `#!/bin/sh
+# su garzon -c COMMAND (there is only one user)
+[ "$2" = "-c" ] || { echo "su: use 'su USER -c COMMAND'" >&2; exit 1; }
+exec sh -c "$3"
+`,
+	"chown":  "#!/bin/sh\n# there is only one user\n",
+	"mount":  "#!/bin/sh\n# the CD-ROM is always mounted\n",
+	"umount": "#!/bin/sh\n# the CD-ROM is always mounted\n",
+}
+
+// NewLocal creates the directories of a Local sandbox in dir.
+func NewLocal(dir string) (*Local, error) {
+	for _, sub := range []string{"cdrom", "io"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("Cannot create '%s': %s", filepath.Join(dir, sub), err)
+		}
+	}
+	return &Local{Dir: dir, buf: make([]byte, 10000)}, nil
+}
+
+func (L *Local) StartAndReset() error {
+	log.Printf("Starting local sandbox...")
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Cannot create pipe: %s", err)
+	}
+	cmd := exec.Command("/proc/self/exe", SandboxInitArg, L.Dir)
+	cmd.Stdout, cmd.Stderr = w, w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Cannot connect to the sandbox's stdin: %s", err)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return fmt.Errorf("Cannot start local sandbox: %s", err)
+	}
+	L.mu.Lock()
+	L.cmd = cmd
+	L.mu.Unlock()
+	L.stdin, L.stdout = stdin, r
+
+	L.stuck = false
+	L.SetDeadline(time.Now().Add(startTimeout))
+	output := L.shell("", nil) // wait for the shell
+	L.SetDeadline(time.Time{})
+	if L.stuck {
+		L.stop()
+		return fmt.Errorf("Local sandbox did not start: %s", strings.TrimSpace(output))
+	}
+	log.Printf("... ready!")
+	L.fresh = true
+	return nil
+}
+
+// stop kills the shell and everything in its namespaces.
+func (L *Local) stop() {
+	L.mu.Lock()
+	cmd := L.cmd
+	L.cmd = nil
+	L.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	L.stdout.Close()
+}
+
+func (L *Local) Reset() {
+	if L.fresh {
+		return
+	}
+	L.stop()
+	if err := L.StartAndReset(); err != nil {
+		log.Printf("Cannot reset local sandbox: %s", err)
+		L.stuck = true
+	}
+}
+
+func (L *Local) Quit() error {
+	log.Printf("Ending local sandbox")
+	L.stop()
+	return nil
+}
+
+func (L *Local) Kill() {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	if L.cmd != nil {
+		L.cmd.Process.Kill()
+	}
+}
+
+func (L *Local) SetDeadline(t time.Time) {
+	L.stdout.SetReadDeadline(t)
+}
+
+func (L *Local) Stuck() bool {
+	return L.stuck
+}
+
+// Recover starts a new shell after the sandbox gets stuck.
+func (L *Local) Recover() error {
+	log.Printf("Recovering...")
+	L.fresh = false
+	L.Reset()
+	if L.stuck {
+		return fmt.Errorf("Cannot restart local sandbox")
+	}
+	return nil
+}
+
+// shell sends a command to the shell followed by one that prints the
+// prompt, since the shell is not interactive.
+func (L *Local) shell(cmd string, report func(string)) string {
+	if L.stuck {
+		return ""
+	}
+	L.fresh = false
+	if cmd != "" {
+		fmt.Fprintf(L.stdin, "%s\n", cmd)
+	}
+	fmt.Fprintf(L.stdin, "printf %s\n", magicPrompt)
+	return L.waitForPrompt(report)
+}
+
+func (L *Local) waitForPrompt(report func(string)) (output string) {
+	pos := 0
+	for !strings.HasSuffix(output, magicPrompt) {
+		n, err := L.stdout.Read(L.buf)
+		output += string(L.buf[:n])
+		for report != nil {
+			newpos := strings.Index(output[pos:], "\n")
+			if newpos == -1 {
+				break
+			}
+			report(output[pos : pos+newpos])
+			pos += newpos + 1
+		}
+		if err != nil {
+			if !L.Interrupted() { // (otherwise Interrupt killed the shell)
+				log.Printf("Local sandbox: %s", err)
+				L.stuck = true
+			}
+			return
+		}
+	}
+	return output[:len(output)-len(magicPrompt)]
+}
+
+func (L *Local) Shell(cmd string) string {
+	return L.shell(cmd, nil)
+}
+
+func (L *Local) ShellReport(cmd string, report func(string)) string {
+	L.mu.Lock()
+	if L.interrupted {
+		L.mu.Unlock()
+		return ""
+	}
+	L.running = true
+	L.mu.Unlock()
+
+	output := L.shell(cmd, report)
+
+	L.mu.Lock()
+	L.running = false
+	L.mu.Unlock()
+	return output
+}
+
+// Interrupt stops the command run by ShellReport by killing the shell
+// (Reset starts a new one).
+func (L *Local) Interrupt() {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	L.interrupted = true
+	if L.running && L.cmd != nil {
+		log.Printf("Interrupting...")
+		L.cmd.Process.Kill()
+	}
+}
+
+func (L *Local) Interrupted() bool {
+	L.mu.Lock()
+	defer L.mu.Unlock()
+	return L.interrupted
+}
+
+func (L *Local) ClearInterrupt() {
+	L.mu.Lock()
+	L.interrupted = false
+	L.mu.Unlock()
+}
+
+// Insert copies the files in dir to the CD-ROM.
+func (L *Local) Insert(dir string) error {
+	L.Eject()
+	if err := copyTree(filepath.Join(L.Dir, "cdrom"), dir); err != nil {
+		return fmt.Errorf("Cannot copy '%s' to the CD-ROM: %s", dir, err)
+	}
+	return nil
+}
+
+// Eject removes the files of the CD-ROM (but not the directory, which is
+// mounted in the sandbox).
+func (L *Local) Eject() {
+	cdrom := filepath.Join(L.Dir, "cdrom")
+	list, err := ioutil.ReadDir(cdrom)
+	if err != nil {
+		log.Printf("Cannot read '%s': %s", cdrom, err)
+		return
+	}
+	for _, info := range list {
+		if err := os.RemoveAll(filepath.Join(cdrom, info.Name())); err != nil {
+			log.Printf("Cannot remove '%s': %s", info.Name(), err)
+		}
+	}
+}
+
+func (L *Local) CopyToGuest(guestfile, hostfile string) error {
+	log.Printf(`CopyToGuest("%s", "%s")`, guestfile, hostfile)
+	if err := copyFile(filepath.Join(L.Dir, "io/file"), hostfile, 0600); err != nil {
+		return fmt.Errorf("Local.CopyToGuest: %s", err)
+	}
+	output := L.Shell(fmt.Sprintf("mv /mnt/io/file %s", guestfile))
+	if L.stuck {
+		return fmt.Errorf("Local.CopyToGuest: timeout")
+	}
+	if output != "" {
+		return fmt.Errorf("Local.CopyToGuest: mv command returned something: %s", output)
+	}
+	return nil
+}
+
+func (L *Local) CopyToHost(hostfile, guestfile string) error {
+	log.Printf(`CopyToHost("%s", "%s")`, hostfile, guestfile)
+	output := L.Shell(fmt.Sprintf("cp %s /mnt/io/file", guestfile))
+	if L.stuck {
+		return fmt.Errorf("Local.CopyToHost: timeout")
+	}
+	if output != "" {
+		return fmt.Errorf("Local.CopyToHost: cp command returned something: %s", output)
+	}
+	iofile := filepath.Join(L.Dir, "io/file")
+	defer os.Remove(iofile)
+	info, err := os.Stat(iofile)
+	if err != nil {
+		return fmt.Errorf("Local.CopyToHost: %s", err)
+	}
+	if err := copyFile(hostfile, iofile, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("Local.CopyToHost: %s", err)
+	}
+	return nil
+}
+
+// copyFile copies a file, truncating dest if it exists.
+func copyFile(dest, source string, perm os.FileMode) error {
+	from, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("Cannot open '%s': %s", source, err)
+	}
+	defer from.Close()
+	to, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("Cannot create '%s': %s", dest, err)
+	}
+	if _, err := io.Copy(to, from); err != nil {
+		to.Close()
+		return fmt.Errorf("Cannot copy '%s': %s", source, err)
+	}
+	return to.Close()
+}
+
+// copyTree copies the files in the directory src into dest, following
+// symbolic links (like 'genisoimage -f').
+func copyTree(dest, src string) error {
+	list, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, info := range list {
+		from, to := filepath.Join(src, info.Name()), filepath.Join(dest, info.Name())
+		info, err := os.Stat(from)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(to, 0700); err != nil {
+				return err
+			}
+			if err := copyTree(to, from); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := copyFile(to, from, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// The Local sandbox needs the namespaces and seccomp of Linux.
+type Local struct {
+	Sandbox
+}
+
+func NewLocal(dir string) (*Local, error) {
+	return nil, fmt.Errorf("The local sandbox is not supported on %s", runtime.GOOS)
+}
+
+func SandboxInit(dir string) error {
+	return fmt.Errorf("The local sandbox is not supported on %s", runtime.GOOS)
+}
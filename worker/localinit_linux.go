@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// SandboxInit runs in the new namespaces of a Local sandbox (as root of
+// its user namespace), with the directory of the sandbox in the host. It
+// makes the mounts, sets the limits and the seccomp filter and becomes
+// the shell, so it only returns if something fails.
+func SandboxInit(dir string) error {
+	runtime.LockOSThread() // the seccomp filter is for this thread only
+	if err := setupSandbox(dir); err != nil {
+		return fmt.Errorf("Local sandbox: %s", err)
+	}
+	env := []string{
+		"PATH=/mnt/bin:/usr/local/bin:/usr/bin:/bin",
+		"HOME=" + os.Getenv("HOME"),
+		"LANG=C",
+		"GARZON_SANDBOX=local",
+	}
+	err := syscall.Exec("/bin/sh", []string{"sh"}, env)
+	return fmt.Errorf("Local sandbox: exec: %s", err)
+}
+
+// setupSandbox makes the layout of the sandbox (see Local).
+func setupSandbox(dir string) error {
+	home := os.Getenv("HOME")
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("private mounts: %s", err)
+	}
+	if err := syscall.Mount("tmpfs", "/mnt", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=1m,mode=755"); err != nil {
+		return fmt.Errorf("mount /mnt: %s", err)
+	}
+	for _, sub := range []string{"cdrom", "io", "bin"} {
+		if err := os.Mkdir("/mnt/"+sub, 0755); err != nil {
+			return fmt.Errorf("mkdir: %s", err)
+		}
+	}
+	if err := bindMount(filepath.Join(dir, "cdrom"), "/mnt/cdrom", true); err != nil {
+		return fmt.Errorf("mount /mnt/cdrom: %s", err)
+	}
+	if err := bindMount(filepath.Join(dir, "io"), "/mnt/io", false); err != nil {
+		return fmt.Errorf("mount /mnt/io: %s", err)
+	}
+	for name, script := range localCommands {
+		if err := ioutil.WriteFile("/mnt/bin/"+name, []byte(script), 0755); err != nil {
+			return fmt.Errorf("write /mnt/bin: %s", err)
+		}
+	}
+	if err := syscall.Mount("", "/mnt", "", syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("remount /mnt: %s", err)
+	}
+
+	// (after the bind mounts, the worker's directories may be in them)
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount /tmp: %s", err)
+	}
+	if home != "" && home != "/" && home != "/tmp" {
+		if err := syscall.Mount("tmpfs", home, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=700"); err != nil {
+			return fmt.Errorf("mount $HOME: %s", err)
+		}
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /proc: %s", err)
+	}
+	if err := syscall.Sethostname([]byte("garzon")); err != nil {
+		return fmt.Errorf("hostname: %s", err)
+	}
+
+	// The limits of each program are set by the run script
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{Cur: 0, Max: 0}); err != nil {
+		return fmt.Errorf("rlimit: %s", err)
+	}
+	if err := setSeccompFilter(); err != nil {
+		return fmt.Errorf("seccomp: %s", err)
+	}
+	return nil
+}
+
+// bindMount mounts the directory src in dst. A read-only mount has to
+// keep the flags of the mount of src, which are locked in the user
+// namespace.
+func bindMount(src, dst string, readOnly bool) error {
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND, ""); err != nil {
+		return err
+	}
+	if !readOnly {
+		return nil
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(src, &st); err != nil {
+		return err
+	}
+	locked := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	return syscall.Mount("", dst, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|locked, "")
+}
+
+// System calls that fail (with EPERM) in the Local sandbox.
+var deniedSyscalls = []uint32{
+	syscall.SYS_PTRACE,
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_CHROOT,
+	syscall.SYS_UNSHARE,
+	syscall.SYS_REBOOT,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_KEYCTL,
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_REQUEST_KEY,
+	syscall.SYS_PERF_EVENT_OPEN,
+	syscall.SYS_ACCT,
+	syscall.SYS_SETTIMEOFDAY,
+	syscall.SYS_SETHOSTNAME,
+	syscall.SYS_SETDOMAINNAME,
+}
+
+// AUDIT_ARCH_* of each GOARCH, which the filter checks.
+var auditArch = map[string]uint32{
+	"386":   0x40000003,
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+}
+
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKill  = 0x00000000
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	x32SyscallBit = 0x40000000
+)
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// setSeccompFilter makes the denied system calls fail in this thread and
+// the programs it runs. The filter looks at the 'struct seccomp_data' of
+// each call: the number at offset 0 and the architecture at offset 4.
+func setSeccompFilter() error {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("No seccomp filter for '%s'", runtime.GOARCH)
+	}
+	filter := []syscall.SockFilter{
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 4),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, arch, 1, 0),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKill),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0),
+	}
+	if runtime.GOARCH == "amd64" { // no x32 system calls
+		filter = append(filter,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetErrno|uint32(syscall.EPERM)))
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, nr, 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetErrno|uint32(syscall.EPERM)))
+	}
+	filter = append(filter, bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow))
+
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
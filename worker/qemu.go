@@ -1,4 +1,4 @@
-package main
+package worker
 
 import (
 	"crypto/sha1"
@@ -11,16 +11,30 @@ import (
 	"path/filepath"
 	"strings"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type QEmu struct {
 	Image  string
 	Root   string
+	Drive  string // copy of the image to use instead (optional)
+	Socket string // for CopyToGuest and CopyToHost (optional)
 	cmd    *exec.Cmd
 	stdin  io.WriteCloser
 	stdout io.ReadCloser
 	fresh  bool
 	// logfile *os.File
+
+	mu          sync.Mutex // protects 'running', 'interrupted' and writes to stdin
+	running     bool       // ShellReport is waiting for a command
+	interrupted bool
+
+	deadline time.Time // for reading QEmu's output (zero = none)
+	stuck    bool      // QEmu did not answer before the deadline (or died)
+
+	buf []byte
+	iso string // in the CD-ROM
 }
 
 var magicPrompt string
@@ -44,12 +58,13 @@ func (Q *QEmu) Filename(which string) (filename string) {
 	case "image":  filename += Q.Image
 	case "io":     filename += Q.Image + ".io"
 	}
+	switch {
+	case which == "image" && Q.Drive != "": filename = Q.Drive
+	case which == "io" && Q.Socket != "":   filename = Q.Socket
+	}
 	return 
 }
 
-
-var iofile string
-
 func (Q *QEmu) args(addargs ...string) (args []string) {
 	args = []string{
 		"-machine", "type=pc,accel=kvm",
@@ -79,6 +94,7 @@ func NewVM(image string) (Q *QEmu, err error) {
 	Q = &QEmu{
 		Image:   image,
 		Root:    root,
+		buf:     make([]byte, 10000),
 	}
 	return
 }
@@ -121,26 +137,79 @@ func (Q *QEmu) start(forceNewPrompt bool) error {
 	if err != nil {
 		return fmt.Errorf("Error executing QEMU: %s", err)
 	}
+	Q.stuck = false
+	Q.SetDeadline(time.Now().Add(startTimeout))
+	defer Q.SetDeadline(time.Time{})
 	if forceNewPrompt {
 		Q.emit("")
 	}
 	Q.waitForPrompt(magicPrompt, nil)
+	if Q.stuck {
+		return fmt.Errorf("QEMU did not start")
+	}
 	Q.Log("... ready!")
 	Q.fresh = true
 	return nil
 }
 
-var buf = make([]byte, 10000)
+// Time to wait for QEmu to start or to load the snapshot.
+const startTimeout = 2 * time.Minute
+
+// SetDeadline makes the commands stop waiting for QEmu at time t (and the
+// QEmu stuck). The zero time means no deadline.
+func (Q *QEmu) SetDeadline(t time.Time) {
+	Q.deadline = t
+	if f, ok := Q.stdout.(*os.File); ok {
+		f.SetReadDeadline(t)
+	}
+}
+
+// Stuck tells if QEmu did not answer in time. Commands do nothing until
+// Recover or Restart are called.
+func (Q *QEmu) Stuck() bool {
+	return Q.stuck
+}
+
+// Recover loads the snapshot after QEmu gets stuck, or restarts it if it
+// still does not answer.
+func (Q *QEmu) Recover() error {
+	Q.Log("Recovering...")
+	Q.stuck = false
+	Q.SetDeadline(time.Now().Add(startTimeout))
+	Q.emitCtrlA_C()
+	Q.emit("loadvm " + SNAPSHOT_NAME)
+	Q.emitCtrlA_C()
+	Q.emit("")
+	Q.waitForPrompt(magicPrompt, nil)
+	Q.SetDeadline(time.Time{})
+	if !Q.stuck {
+		Q.fresh = true
+		return nil
+	}
+	return Q.Restart()
+}
+
+// Restart kills QEmu and starts it again from the snapshot.
+func (Q *QEmu) Restart() error {
+	Q.Log("Restarting QEMU...")
+	Q.Kill()
+	Q.cmd.Wait()
+	Q.cmd = exec.Command("qemu-system-i386", Q.args("-loadvm", SNAPSHOT_NAME)...)
+	return Q.start(true)
+}
 
 func (Q *QEmu) waitForPrompt(prompt string, report func(string)) (output string) {
+	if Q.stuck {
+		return ""
+	}
 	pos := 0
 	for {
-		n, err := Q.stdout.Read(buf)
+		n, err := Q.stdout.Read(Q.buf)
 		if n > 10000 {
 			panic("Buffer overflow!")
 		}
-		output += string(buf[:n])
-		// Q.logfile.Write(buf[:n])
+		output += string(Q.buf[:n])
+		// Q.logfile.Write(Q.buf[:n])
 		newpos := strings.Index(output[pos:], "\n")
 		if newpos != -1 {
 			if report != nil {
@@ -148,9 +217,15 @@ func (Q *QEmu) waitForPrompt(prompt string, report func(string)) (output string)
 			}
 			pos += newpos + 1
 		}
-		if err != io.EOF && err != nil {
+		if os.IsTimeout(err) {
+			Q.Log("Monitor: timeout waiting for '%s'", prompt)
+			Q.stuck = true
+			return
+		}
+		if err != nil {
 			Q.Log("Monitor: read error: %s", err)
-			break
+			Q.stuck = true
+			return
 		}
 		if strings.HasSuffix(output, prompt) {
 			// Q.Log("> `%s`", output)
@@ -162,17 +237,30 @@ func (Q *QEmu) waitForPrompt(prompt string, report func(string)) (output string)
 }
 
 func (Q *QEmu) emit(cmd string) {
+	if Q.stuck {
+		return // it would run after Recover
+	}
 	Q.fresh = false
-	fmt.Fprintf(Q.stdin, "%s\n", cmd)
+	Q.write([]byte(cmd + "\n"))
 	// fmt.Fprintf(Q.logfile, "%s\n", cmd)
 }
 
 func (Q *QEmu) emitCtrlA_C() {
 	Q.fresh = false
-	Q.stdin.Write([]byte{0x01, 0x63}) // emit "ctrl+a c"
+	Q.write(ctrlA_C) // emit "ctrl+a c"
 	// Q.logfile.Write([]byte{0x01, 0x63})
 }
 
+var ctrlA_C = []byte{0x01, 0x63}
+
+// write sends data to QEmu's stdin, so that it does not interleave with
+// what Interrupt sends.
+func (Q *QEmu) write(data []byte) {
+	Q.mu.Lock()
+	Q.stdin.Write(data)
+	Q.mu.Unlock()
+}
+
 func (Q *QEmu) Monitor(cmd string) (output string) {
 	Q.fresh = false
 
@@ -202,8 +290,55 @@ func (Q *QEmu) ShellLog(cmd string) string {
 	return output
 }
 
+// ShellReport runs a command reporting each line of output, and can be
+// stopped with Interrupt.
 func (Q *QEmu) ShellReport(cmd string, report func(string)) string {
-	return Q.shell(cmd, report)
+	Q.mu.Lock()
+	if Q.interrupted {
+		Q.mu.Unlock()
+		return ""
+	}
+	Q.running = true
+	Q.mu.Unlock()
+
+	output := Q.shell(cmd, report)
+
+	Q.mu.Lock()
+	Q.running = false
+	Q.mu.Unlock()
+	return output
+}
+
+// Interrupt stops the command run by ShellReport by loading the snapshot
+// (it can be called from another goroutine). If no command is running,
+// the next ShellReport will not run, until ClearInterrupt is called.
+func (Q *QEmu) Interrupt() {
+	Q.mu.Lock()
+	defer Q.mu.Unlock()
+	Q.interrupted = true
+	if Q.running {
+		// (written at once and without touching the state of the slot's
+		// goroutine, which is waiting for the prompt in shell)
+		Q.Log("Interrupting...")
+		var keys []byte
+		keys = append(keys, ctrlA_C...)
+		keys = append(keys, "loadvm "+SNAPSHOT_NAME+"\n"...)
+		keys = append(keys, ctrlA_C...)
+		keys = append(keys, '\n') // make the shell print the prompt again
+		Q.stdin.Write(keys)
+	}
+}
+
+func (Q *QEmu) Interrupted() bool {
+	Q.mu.Lock()
+	defer Q.mu.Unlock()
+	return Q.interrupted
+}
+
+func (Q *QEmu) ClearInterrupt() {
+	Q.mu.Lock()
+	Q.interrupted = false
+	Q.mu.Unlock()
 }
 
 func (Q *QEmu) shell(cmd string, report func(string)) (output string) {
@@ -212,23 +347,51 @@ func (Q *QEmu) shell(cmd string, report func(string)) (output string) {
 	return Q.waitForPrompt(magicPrompt, report)
 }
 
-func (Q *QEmu) Quit() {
-	Q.Log("Ending QEMU")
+// Time to wait for QEmu to quit before killing it.
+const quitTimeout = 30 * time.Second
 
-	Q.emitCtrlA_C()
-	Q.waitForPrompt("(qemu) ", nil)
-	Q.emit("quit")
+// Quit asks QEmu to quit, and kills it if it is stuck or does not end
+// in quitTimeout.
+func (Q *QEmu) Quit() error {
+	Q.Log("Ending QEMU")
+	if Q.cmd == nil || Q.cmd.Process == nil {
+		return nil // not started
+	}
+	if !Q.stuck {
+		Q.SetDeadline(time.Now().Add(quitTimeout))
+		Q.emitCtrlA_C()
+		Q.waitForPrompt("(qemu) ", nil)
+		Q.emit("quit")
+	}
+	killed := Q.stuck
+	if killed {
+		Q.Log("QEMU is stuck, killing it")
+		Q.Kill()
+	}
 
 	Q.Log("Waiting for QEMU to finish...")
-	err := Q.cmd.Wait()
-	if err != nil {
-		log.Fatalf("Wait: %s", err)
+	done := make(chan error, 1)
+	go func() { done <- Q.cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(quitTimeout):
+		Q.Log("QEMU does not finish, killing it")
+		killed = true
+		Q.Kill()
+		err = <-done
+	}
+	if err != nil && !killed {
+		return fmt.Errorf("QEMU did not end well: %s", err)
 	}
 	Q.Log("... bye!")
+	return nil
 }
 
 func (Q *QEmu) Kill() {
-	Q.cmd.Process.Kill()
+	if Q.cmd != nil && Q.cmd.Process != nil {
+		Q.cmd.Process.Kill()
+	}
 }
 
 const SNAPSHOT_NAME = "grz"
@@ -247,13 +410,45 @@ func (Q *QEmu) Reset() {
 	}
 }
 
+// Insert makes an ISO image with the files in dir (next to it) and puts
+// it in the CD-ROM.
+func (Q *QEmu) Insert(dir string) error {
+	iso := dir + ".iso"
+	geniso := exec.Command("genisoimage",
+		"-f", // follow symlinks
+		// "-file-mode", "400", // read-only for tc
+		"-uid", "5000", // garzon user = 5000 (tc = 1001)
+		"-o", iso,
+		dir)
+
+	if output, err := geniso.CombinedOutput(); err != nil {
+		return fmt.Errorf("genisoimage error: %s\noutput:\n%s", err, output)
+	}
+	Q.iso = iso
+	Q.Monitor("change ide1-cd0 " + iso)
+	return nil
+}
+
+// Eject removes the ISO image from the CD-ROM.
+func (Q *QEmu) Eject() {
+	Q.Monitor("eject ide1-cd0")
+	if Q.iso == "" {
+		return
+	}
+	if err := os.Remove(Q.iso); err != nil {
+		Q.Log("Cannot remove '%s': %s", Q.iso, err)
+	}
+	Q.iso = ""
+}
+
 func (Q *QEmu) CopyToGuest(vmfile, hostfile string) error {
 	Q.Log(`CopyToVM("%s", "%s")`, vmfile, hostfile)
 
 	// 1. Prepare goroutine that copies file to socket
 	var goerr error
-	finished := make(chan bool)
+	finished := make(chan bool, 1)
 	go func() {
+		defer func() { finished <- true }()
 		fin, err := os.Open(hostfile)
 		if err != nil {
 			goerr = err
@@ -264,6 +459,7 @@ func (Q *QEmu) CopyToGuest(vmfile, hostfile string) error {
 			goerr = err
 			return
 		}
+		conn.SetDeadline(Q.deadline)
 		bytes, err := io.Copy(conn, fin)
 		if err != nil {
 			goerr = err
@@ -276,11 +472,13 @@ func (Q *QEmu) CopyToGuest(vmfile, hostfile string) error {
 		if err := conn.Close(); err != nil {
 			goerr = fmt.Errorf(`QEmu.CopyToGuest: Cannot close connection: %s`, err)
 		}
-		finished <- true
 	}()
 
 	// 2. Copy the file
 	output := Q.Shell(fmt.Sprintf(`cat /dev/virtio-ports/io.0 > %s`, vmfile))
+	if Q.stuck {
+		return fmt.Errorf("QEmu.CopyToGuest: timeout")
+	}
 	if output != "" {
 		return fmt.Errorf("QEmu.CopyToGuest: cat command returned something: %s", output)
 	}
@@ -297,7 +495,10 @@ func (Q *QEmu) CopyToHost(hostfile, vmfile string) error {
 
 	// 0. Find out the size of the file
 	output := Q.Shell(fmt.Sprintf(`ls -l %s | tr -s ' ' | cut -d' ' -f5`, vmfile))
-	output = output[:len(output)-2] // get rid of '\r\n'
+	if Q.stuck {
+		return fmt.Errorf("QEmu.CopyToHost: timeout")
+	}
+	output = strings.TrimSpace(output) // get rid of '\r\n'
 	nbytes, err := strconv.ParseInt(output, 10, 64)
 	if err != nil {
 		return fmt.Errorf(`QEmu.CopyToHost: Cannot determine file size from '%s': %s`, output, err)
@@ -306,7 +507,7 @@ func (Q *QEmu) CopyToHost(hostfile, vmfile string) error {
 
 	// 1. Pipe the file
 	var goerr error
-	finished := make(chan bool)
+	finished := make(chan bool, 1)
 	go func() {
 		output := Q.Shell(fmt.Sprintf(`cat %s > /dev/virtio-ports/io.0`, vmfile))
 		if output != "" {
@@ -325,6 +526,7 @@ func (Q *QEmu) CopyToHost(hostfile, vmfile string) error {
 	if err != nil {
 		return fmt.Errorf(`QEmu.CopyToHost: Cannot dial unix socket: %s`, err)
 	}
+	conn.SetDeadline(Q.deadline)
 	ncopied, err := io.CopyN(fout, conn, nbytes)
 	if err != nil {
 		return fmt.Errorf(`QEmu.CopyToHost: Cannot copy from unix socket: %s`, err)
@@ -0,0 +1,54 @@
+package worker
+
+import "time"
+
+// A Sandbox is where the worker compiles and runs programs: a QEmu VM
+// or, on machines without KVM, a Local sandbox in the host. Commands see
+// the same layout in both: the CD-ROM with the files of the job in
+// '/mnt/cdrom', a clean '/tmp' after Reset, a user 'garzon' for the
+// solutions and the judge script 'garzon.sh'.
+type Sandbox interface {
+	// StartAndReset starts the sandbox in its clean state.
+	StartAndReset() error
+	// Reset goes back to the clean state.
+	Reset()
+	// Quit stops the sandbox, Kill stops it at once.
+	Quit() error
+	Kill()
+
+	// Shell runs a command and returns its output.
+	Shell(cmd string) string
+	// ShellReport runs a command reporting each line of output, and can
+	// be stopped with Interrupt (from another goroutine).
+	ShellReport(cmd string, report func(string)) string
+	Interrupt()
+	Interrupted() bool
+	ClearInterrupt()
+
+	CopyToGuest(guestfile, hostfile string) error
+	CopyToHost(hostfile, guestfile string) error
+
+	// Insert makes the files in a directory of the host the CD-ROM, and
+	// Eject removes them.
+	Insert(dir string) error
+	Eject()
+
+	// SetDeadline makes the commands stop waiting at time t (the zero
+	// time means no deadline). After that the sandbox is stuck and
+	// commands do nothing until Recover is called.
+	SetDeadline(t time.Time)
+	Stuck() bool
+	Recover() error
+}
+
+// Argument with which the worker runs SandboxInit (it must be the first).
+// Programs that use Local sandboxes must check it before anything else,
+// as grz-worker does.
+const SandboxInitArg = "-sandbox-init"
+
+// Kinds of sandbox (Worker.SandboxType)
+const (
+	QEmuSandbox  = "qemu"
+	LocalSandbox = "local"
+	FakeSandbox  = "fake" // with NewSandbox returning Fakes
+)
@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// A Slot is one of the VMs (or sandboxes) of the worker, with its own
+// temporary directory (inside the worker's) and its own connection to
+// the server. Each slot evaluates one job at a time.
+type Slot struct {
+	w   *Worker
+	id  int
+	dir string
+	box Sandbox
+	ws  *websocket.Conn // with w.mu locked (for Close)
+
+	watchdog struct {
+		phase string
+		job   time.Time // deadline of the whole job
+	}
+	lost error // the sandbox could not be recovered (Serve stops)
+
+	// The job being evaluated, which the server may cancel, and its
+	// phase (for the status reported in pongs).
+	currentJob struct {
+		sync.Mutex
+		id       string
+		phase    string
+		deadline time.Time
+	}
+}
+
+// NewSlot creates the directory of a slot and starts its sandbox (with
+// w.NewSandbox or of type w.SandboxType). If the worker has several VMs,
+// each one uses a copy of the image (QEmu cannot share one image between
+// VMs that load snapshots).
+func NewSlot(w *Worker, id int) (*Slot, error) {
+	s := &Slot{w: w, id: id, dir: filepath.Join(w.tempdir, fmt.Sprintf("slot-%d", id))}
+	if err := os.Mkdir(s.dir, 0700); err != nil {
+		return nil, fmt.Errorf("Cannot create '%s': %s", s.dir, err)
+	}
+	var err error
+	switch {
+	case w.NewSandbox != nil:
+		s.box, err = w.NewSandbox(id, s.Tmp("sandbox"))
+	case w.SandboxType == LocalSandbox:
+		s.box, err = NewLocal(s.Tmp("local"))
+	default:
+		s.box, err = s.newVM(w.VMs > 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.box.StartAndReset(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Slot) newVM(copyImage bool) (*QEmu, error) {
+	vm, err := NewVM(s.w.Image)
+	if err != nil {
+		return nil, err
+	}
+	vm.Socket = s.Tmp("io")
+	if copyImage {
+		vm.Drive = s.Tmp(filepath.Base(s.w.Image))
+		log.Printf("Copying image to '%s'", vm.Drive)
+		if _, err := CopyFile(vm.Drive, filepath.Join(vm.Root, s.w.Image), -1); err != nil {
+			return nil, err
+		}
+	}
+	return vm, nil
+}
+
+// Tmp returns the path of a file in the directory of the slot.
+func (s *Slot) Tmp(filename string) string {
+	return filepath.Join(s.dir, filename)
+}
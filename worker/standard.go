@@ -0,0 +1,254 @@
+package worker
+
+import (
+	"fmt"
+	gsrv "garzon/server"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The standard judge compiles the solution in the sandbox (the "VM"), runs
+// it with each 'tests/<name>.in' of the problem as input and compares the
+// output with 'tests/<name>.out' using the checker of the problem (in the
+// host, or in the VM for checker programs). The CD-ROM is mounted in
+// '/mnt/cdrom' (except while the solution runs) and everything else
+// happens in '/tmp' of the VM.
+
+type testCase struct {
+	name    string
+	in, out string // files in the host
+	vmInput string // files in the VM
+	vmOut   string
+}
+
+// findTests returns the test cases of a problem, which must have
+// expected output if needOut.
+func findTests(problemDir string, needOut bool) (tests []testCase, err error) {
+	inputs, err := filepath.Glob(filepath.Join(problemDir, "tests", "*.in"))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot glob 'tests/*.in': %s", err)
+	}
+	for _, in := range inputs {
+		name := strings.TrimSuffix(filepath.Base(in), ".in")
+		out := strings.TrimSuffix(in, ".in") + ".out"
+		if needOut && !isFile(out) {
+			return nil, fmt.Errorf("Test '%s' has no '.out' file", name)
+		}
+		tests = append(tests, testCase{
+			name:    name,
+			in:      in,
+			out:     out,
+			vmInput: "/mnt/cdrom/problem/tests/" + name + ".in",
+			vmOut:   "/mnt/cdrom/problem/tests/" + name + ".out",
+		})
+	}
+	if len(tests) == 0 {
+		return nil, fmt.Errorf("No tests in '%s'", filepath.Join(problemDir, "tests"))
+	}
+	return tests, nil
+}
+
+func isFile(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// shellQuote quotes a string for the shell of the VM.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runInVM executes a command in the VM (in a way that can be
+// interrupted) and returns its exit status and output.
+func (s *Slot) runInVM(cmd string) (status int, output string, err error) {
+	out := s.box.ShellReport(fmt.Sprintf("(%s) > /tmp/run.log 2>&1; echo $?", cmd), nil)
+	if s.box.Interrupted() {
+		return 0, "", fmt.Errorf("Cancelled")
+	}
+	status, err = strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return 0, "", fmt.Errorf("Cannot get exit status of '%s': '%s'", cmd, out)
+	}
+	output = s.box.Shell("cat /tmp/run.log")
+	return status, strings.Replace(output, "\r\n", "\n", -1), nil
+}
+
+// EvalStandard evaluates a solution with the tests of a problem, which
+// must be in the CD-ROM.
+func (s *Slot) EvalStandard(problemDir string, manifest gsrv.Manifest, language string, report func(msg string)) (verdict gsrv.Verdict, err error) {
+	tests, err := findTests(problemDir, true)
+	if err != nil {
+		return verdict, err
+	}
+	checker := manifest.Checker
+	var program string
+	if checker.Type == gsrv.ProgramChecker {
+		program = checker.Program
+	}
+	limits := SolutionLimits(manifest)
+	return s.evalTests(tests, language, program, func(test testCase, solution, checkerCmd string) (gsrv.TestResult, error) {
+		return s.runTest(test, limits.Command(solution), checker, checkerCmd)
+	}, report)
+}
+
+// evalTests compiles the solution (and a program of the problem, like a
+// checker) and runs each test, adding up the results. The run function
+// receives the commands that run both programs.
+func (s *Slot) evalTests(tests []testCase, language, program string, run func(test testCase, solution, program string) (gsrv.TestResult, error), report func(msg string)) (verdict gsrv.Verdict, err error) {
+	if language == "" {
+		language = gsrv.DefaultLanguage // (the server says it)
+	}
+	lang := FindLanguage(language)
+	if lang == nil {
+		return verdict, fmt.Errorf("Language '%s' not supported", language)
+	}
+	s.startPhase("compile", s.w.CompileTimeout)
+	s.box.Shell("mount /dev/cdrom /mnt/cdrom")
+	defer s.box.Shell("umount /mnt/cdrom")
+	s.setupShell()
+
+	report("Compiling...")
+	ok, msg, err := s.compileSolution(lang)
+	if err != nil {
+		return verdict, err
+	}
+	if !ok {
+		return gsrv.Verdict{Status: gsrv.CompileError, Message: msg}, nil
+	}
+	s.box.Shell("mkdir /tmp/run && chown garzon /tmp/run")
+	s.box.Shell(fmt.Sprintf("mkdir -p /tmp/bin && cp /mnt/cdrom/run %s && chmod 755 %s", runScriptPath, runScriptPath))
+
+	var programCmd string
+	if program != "" {
+		if programCmd, err = s.compileProgram(program); err != nil {
+			return verdict, err
+		}
+	}
+	s.box.Shell("umount /mnt/cdrom") // (the solution must not see the tests)
+
+	verdict.Status = gsrv.Accepted
+	passed := 0
+	for _, test := range tests {
+		s.startPhase("run", s.w.RunTimeout)
+		result, err := run(test, lang.RunCommand("/tmp/solution"), programCmd)
+		if err != nil {
+			return verdict, err
+		}
+		report(fmt.Sprintf("Test %s: %s", test.name, result.Status.Title()))
+		verdict.Tests = append(verdict.Tests, result)
+		if result.Status == gsrv.Accepted {
+			passed++
+		} else if verdict.Status == gsrv.Accepted {
+			verdict.Status = result.Status
+		}
+	}
+	verdict.Score = float64(passed) / float64(len(tests))
+	return verdict, nil
+}
+
+// compileSolution compiles the solution (in the CD-ROM) into
+// '/tmp/solution' in the VM. If it does not compile, it returns the
+// messages of the compiler.
+func (s *Slot) compileSolution(lang *Language) (ok bool, msg string, err error) {
+	status, output, err := s.runInVM(lang.CompileCommand("/mnt/cdrom/solution", "/tmp/solution"))
+	if err != nil {
+		return false, "", err
+	}
+	if status != 0 {
+		return false, output, nil
+	}
+	s.box.Shell("chmod 755 /tmp/solution*")
+	return true, "", nil
+}
+
+// compileProgram compiles a program of the problem (a checker or an
+// interactor) into '/tmp/program' in the VM, and returns the command
+// that runs it.
+func (s *Slot) compileProgram(program string) (cmd string, err error) {
+	lang := LanguageOf(program)
+	if lang == nil {
+		return "", fmt.Errorf("Cannot compile '%s': language not supported", program)
+	}
+	status, output, err := s.runInVM(lang.CompileCommand(shellQuote("/mnt/cdrom/problem/"+program), "/tmp/program"))
+	if err != nil {
+		return "", err
+	}
+	if status != 0 {
+		return "", fmt.Errorf("'%s' does not compile:\n%s", program, output)
+	}
+	return lang.RunCommand("/tmp/program"), nil
+}
+
+// runChecker runs the checker program for a test.
+func (s *Slot) runChecker(test testCase, checker string) (result gsrv.TestResult, err error) {
+	result.Name = test.name
+	s.startPhase("check", s.w.RunTimeout)
+	s.box.Shell("mount /dev/cdrom /mnt/cdrom")
+	cmd := fmt.Sprintf("%s /tmp/run/input %s /tmp/run/output", checker, shellQuote(test.vmOut))
+	status, output, err := s.runInVM(cmd)
+	s.box.Shell("umount /mnt/cdrom")
+	if err != nil {
+		return result, err
+	}
+	result.Message = strings.TrimSpace(output)
+	switch status {
+	case 0:
+		result.Status = gsrv.Accepted
+	case 1:
+		result.Status = gsrv.WrongAnswer
+	default:
+		return result, fmt.Errorf("Checker failed with status %d: %s", status, result.Message)
+	}
+	return result, nil
+}
+
+// copyInput copies the input of a test to '/tmp/run/input', mounting the
+// CD-ROM only meanwhile: solutions run as 'garzon', who owns the files
+// of the CD-ROM, so it must not be mounted while they run.
+func (s *Slot) copyInput(test testCase) {
+	s.box.Shell(fmt.Sprintf("mount /dev/cdrom /mnt/cdrom && cp %s /tmp/run/input; umount /mnt/cdrom", shellQuote(test.vmInput)))
+}
+
+// runTest runs the solution with the input of a test, as user 'garzon',
+// and checks its output.
+func (s *Slot) runTest(test testCase, solution string, checker gsrv.Checker, checkerCmd string) (result gsrv.TestResult, err error) {
+	result.Name = test.name
+	s.copyInput(test)
+	status, stderr, err := s.runInVM(fmt.Sprintf(`su garzon -c "cd /tmp/run && exec %s < input > output"`, solution))
+	if err != nil {
+		return result, err
+	}
+	if status != 0 {
+		result.Status, result.Message = Classify(status, stderr)
+		log.Printf("Test '%s': %s", test.name, result.Status)
+		return result, nil
+	}
+	if checker.Type == gsrv.ProgramChecker {
+		return s.runChecker(test, checkerCmd)
+	}
+
+	if err := s.box.CopyToHost(s.Tmp("output"), "/tmp/run/output"); err != nil {
+		return result, err
+	}
+	output, err := ioutil.ReadFile(s.Tmp("output"))
+	if err != nil {
+		return result, fmt.Errorf("Cannot read output: %s", err)
+	}
+	expected, err := ioutil.ReadFile(test.out)
+	if err != nil {
+		return result, fmt.Errorf("Cannot read '%s': %s", test.out, err)
+	}
+	ok, msg := Check(checker, expected, output)
+	if ok {
+		result.Status = gsrv.Accepted
+	} else {
+		result.Status = gsrv.WrongAnswer
+		result.Message = msg
+	}
+	log.Printf("Test '%s': %s", test.name, result.Status)
+	return result, nil
+}
@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Limits for uncompressed problems
+const (
+	maxProblemBytes = 1 << 30
+	maxProblemFiles = 10000
+)
+
+// insideRoot tells if a slash-separated relative path stays inside the
+// directory where it is extracted.
+func insideRoot(name string) bool {
+	name = path.Clean(name)
+	return name != ".." && !strings.HasPrefix(name, "../") && !path.IsAbs(name)
+}
+
+// resolvesInside tells if a slash-separated relative path stays inside
+// the root when the symlinks of the problem (links, by name) are
+// followed, also those that other links point through.
+func resolvesInside(name string, links map[string]string) bool {
+	var (
+		parts = strings.Split(name, "/")
+		cur   []string
+		hops  int
+	)
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(cur) == 0 {
+				return false
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		cur = append(cur, part)
+		if link, ok := links[strings.Join(cur, "/")]; ok {
+			if hops++; hops > 40 || path.IsAbs(link) {
+				return false
+			}
+			cur = cur[:len(cur)-1]
+			parts = append(strings.Split(link, "/"), parts...)
+		}
+	}
+	return true
+}
+
+// Untar extracts a tar.gz into dir, which must exist. Only directories,
+// regular files and symlinks pointing inside dir are accepted, and
+// nothing can be written outside dir or through a symlink. Symlinks are
+// checked again at the end, following the others, since a chain of
+// links can point outside dir even if each one looks inside.
+func Untar(targz []byte, dir string) error {
+	zr, err := gzip.NewReader(bytes.NewReader(targz))
+	if err != nil {
+		return fmt.Errorf("Untar: %s", err)
+	}
+	tr := tar.NewReader(zr)
+
+	var (
+		nfiles   int
+		nbytes   int64
+		symlinks = make(map[string]string) // name -> link
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Untar: %s", err)
+		}
+		if nfiles++; nfiles > maxProblemFiles {
+			return fmt.Errorf("Untar: more than %d files", maxProblemFiles)
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		if !insideRoot(name) {
+			return fmt.Errorf("Untar: '%s' is outside the problem", hdr.Name)
+		}
+		for p := path.Dir(name); p != "."; p = path.Dir(p) {
+			if _, ok := symlinks[p]; ok {
+				return fmt.Errorf("Untar: '%s' is inside symlink '%s'", hdr.Name, p)
+			}
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return fmt.Errorf("Untar: %s", err)
+			}
+
+		case tar.TypeReg, tar.TypeRegA:
+			if nbytes += hdr.Size; nbytes > maxProblemBytes {
+				return fmt.Errorf("Untar: more than %d bytes", maxProblemBytes)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return fmt.Errorf("Untar: %s", err)
+			}
+			var mode os.FileMode = 0600
+			if hdr.Mode&0111 != 0 {
+				mode = 0700
+			}
+			file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return fmt.Errorf("Untar: %s", err)
+			}
+			_, err = io.CopyN(file, tr, hdr.Size)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("Untar: cannot write '%s': %s", hdr.Name, err)
+			}
+
+		case tar.TypeSymlink:
+			link := hdr.Linkname
+			if path.IsAbs(link) || !insideRoot(path.Join(path.Dir(name), link)) {
+				return fmt.Errorf("Untar: symlink '%s' points outside the problem", hdr.Name)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return fmt.Errorf("Untar: %s", err)
+			}
+			if err := os.Symlink(filepath.FromSlash(link), target); err != nil {
+				return fmt.Errorf("Untar: %s", err)
+			}
+			symlinks[name] = link
+
+		default:
+			return fmt.Errorf("Untar: '%s' has a forbidden type (%c)", hdr.Name, hdr.Typeflag)
+		}
+	}
+	for name := range symlinks {
+		if !resolvesInside(name, symlinks) {
+			return fmt.Errorf("Untar: symlink '%s' points outside the problem", name)
+		}
+	}
+	return nil
+}
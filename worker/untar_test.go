@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// entry is a file of a test tar.gz: a directory if its name ends in '/',
+// a symlink if link is not empty and a regular file otherwise.
+type entry struct {
+	name, link, data string
+}
+
+func makeTargz(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.data))}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.data))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestUntar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	targz := makeTargz(t,
+		entry{name: "tests/"},
+		entry{name: "tests/1.in", data: "1 2\n"},
+		entry{name: "tests/1.out", data: "3\n"},
+		entry{name: "sample.in", link: "tests/1.in"},
+		entry{name: "tests/all", link: ".."},
+	)
+	if err := Untar(targz, dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sample.in"))
+	if err != nil || string(data) != "1 2\n" {
+		t.Errorf("sample.in = %q (%v), want the contents of tests/1.in", data, err)
+	}
+}
+
+func TestUntarRejects(t *testing.T) {
+	tests := []struct {
+		what    string
+		entries []entry
+	}{
+		{"parent dir", []entry{{name: "../evil", data: "x"}}},
+		{"absolute path", []entry{{name: "/tmp/evil", data: "x"}}},
+		{"absolute symlink", []entry{{name: "passwd", link: "/etc/passwd"}}},
+		{"symlink to parent", []entry{{name: "up", link: "../.."}}},
+		{"file through symlink", []entry{
+			{name: "dir", link: "."},
+			{name: "dir/evil", data: "x"},
+		}},
+		{"chain of symlinks", []entry{
+			{name: "a/b/", data: ""},
+			{name: "a/b/up", link: ".."},
+			{name: "a/escape", link: "b/up/../.."},
+		}},
+		{"symlink through symlink", []entry{
+			{name: "d/", data: ""},
+			{name: "d/root", link: ".."},
+			{name: "out", link: "d/root/.."},
+		}},
+		{"symlink loop", []entry{
+			{name: "x", link: "y"},
+			{name: "y", link: "x"},
+		}},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "untar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Untar(makeTargz(t, test.entries...), dir); err == nil {
+			t.Errorf("%s: Untar did not fail", test.what)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"fmt"
+	gsrv "garzon/server"
+	"log"
+	"time"
+)
+
+// Every phase of a job in the VM (copying files, compiling and running
+// each test) has a deadline, and so does the whole job. When one passes,
+// the sandbox is stuck: its commands return at once, the job gets a
+// verdict saying so, and the sandbox is recovered before the next job.
+
+// startJob starts the deadline of the whole job.
+func (s *Slot) startJob() {
+	s.watchdog.phase = ""
+	s.watchdog.job = time.Now().Add(s.w.JobTimeout)
+}
+
+// startPhase sets the deadline of the next commands in the VM.
+func (s *Slot) startPhase(phase string, timeout time.Duration) {
+	s.watchdog.phase = phase
+	deadline := time.Now().Add(timeout)
+	if deadline.After(s.watchdog.job) {
+		deadline = s.watchdog.job
+	}
+	s.box.SetDeadline(deadline)
+	s.setPhase(phase, deadline)
+}
+
+// endJob removes the deadlines. If the sandbox got stuck, it recovers it
+// and returns the verdict for the job: TimeLimit if it was running the
+// solution, JudgeError otherwise (also if the judge, the checker or the
+// interactor hung). If it cannot be recovered, the slot is lost.
+func (s *Slot) endJob() *gsrv.Verdict {
+	s.box.SetDeadline(time.Time{})
+	s.setPhase("", time.Time{})
+	if !s.box.Stuck() {
+		return nil
+	}
+	msg := fmt.Sprintf("Timeout in phase '%s'", s.watchdog.phase)
+	if time.Now().After(s.watchdog.job) {
+		msg = fmt.Sprintf("The evaluation took more than %s (phase '%s')", s.w.JobTimeout, s.watchdog.phase)
+	}
+	log.Printf("%s", msg)
+	if err := s.box.Recover(); err != nil {
+		s.lost = fmt.Errorf("Cannot recover VM: %s", err)
+		return &gsrv.Verdict{Status: gsrv.JudgeError, Message: msg}
+	}
+	status := gsrv.JudgeError
+	if s.watchdog.phase == "run" {
+		status = gsrv.TimeLimit
+	}
+	return &gsrv.Verdict{Status: status, Message: msg}
+}
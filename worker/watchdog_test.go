@@ -0,0 +1,65 @@
+package worker
+
+import (
+	gsrv "garzon/server"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	tests := []struct {
+		phase string
+		want  gsrv.Status
+	}{
+		{"run", gsrv.TimeLimit},
+		{"compile", gsrv.JudgeError},
+		{"judge", gsrv.JudgeError},
+		{"check", gsrv.JudgeError},
+		{"interact", gsrv.JudgeError},
+	}
+	for _, test := range tests {
+		box := NewFake(nil)
+		box.Delay = time.Second
+		s := &Slot{w: New(""), box: box}
+		s.startJob()
+		s.startPhase(test.phase, 10*time.Millisecond)
+		if box.wait() {
+			t.Fatalf("Phase '%s' did not time out", test.phase)
+		}
+		v := s.endJob()
+		if v == nil || v.Status != test.want {
+			t.Errorf("Verdict after a timeout in phase '%s': %+v, want %s", test.phase, v, test.want)
+		}
+		if box.Stuck() || s.lost != nil {
+			t.Errorf("The sandbox was not recovered after phase '%s'", test.phase)
+		}
+	}
+}
+
+func TestWatchdogJob(t *testing.T) {
+	box := NewFake(nil)
+	box.Delay = 10 * time.Millisecond
+	s := &Slot{w: New(""), box: box}
+	s.w.JobTimeout = 50 * time.Millisecond
+
+	// Within its deadlines, a job gets no verdict from the watchdog
+	s.startJob()
+	s.startPhase("run", time.Minute)
+	if !box.wait() {
+		t.Fatalf("Phase 'run' timed out")
+	}
+	if v := s.endJob(); v != nil {
+		t.Errorf("Verdict of a job in time: %+v", v)
+	}
+
+	// Each phase ends with the job at the latest
+	s.startJob()
+	box.Delay = time.Second
+	s.startPhase("run", time.Minute)
+	box.wait()
+	v := s.endJob()
+	if v == nil || v.Status != gsrv.TimeLimit || !strings.Contains(v.Message, "took more than") {
+		t.Errorf("Verdict after the job timed out: %+v", v)
+	}
+}
@@ -0,0 +1,766 @@
+package worker
+
+import (
+	"crypto/sha1"
+	"fmt"
+	gsrv "garzon/server"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// A Worker evaluates the jobs of a server with one or more sandboxes
+// (its slots). Create it with New, change its fields if needed, and call
+// Start and then Serve.
+type Worker struct {
+	Server      string   // address of the server (host:port)
+	Secret      string   // to authenticate with the server (optional)
+	SandboxType string   // QEmuSandbox or LocalSandbox
+	Image       string   // image of the VMs
+	VMs         int      // number of slots (jobs evaluated at the same time)
+	Languages   []string // installed in the image
+	Labels      []string // other capabilities
+	CacheSize   int      // number of problems to keep in the cache
+	HomeDir     string   // for the cache and the compiled judges
+
+	// Timeouts of the phases of a job and of the whole job (see
+	// watchdog.go)
+	CopyTimeout    time.Duration
+	CompileTimeout time.Duration
+	RunTimeout     time.Duration
+	JobTimeout     time.Duration
+
+	// NewSandbox, if set, creates the sandbox of each slot (in dir)
+	// instead of SandboxType, e.g. a Fake.
+	NewSandbox func(slot int, dir string) (Sandbox, error)
+
+	tempdir  string
+	versions map[string]string // of the languages, asked to the VM
+	cacheMu  sync.Mutex
+	slots    []*Slot
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex // for closed and the connections of the slots
+	closed bool
+	done   chan bool // closed by Close
+}
+
+// New returns a worker for the server at address grzServer, with the
+// default values of the flags of grz-worker.
+func New(grzServer string) *Worker {
+	return &Worker{
+		Server:         grzServer,
+		SandboxType:    QEmuSandbox,
+		Image:          "garzon.qcow2",
+		VMs:            1,
+		Languages:      []string{"c", "c++", "go"},
+		CacheSize:      50,
+		HomeDir:        filepath.Join(os.Getenv("HOME"), ".grz"),
+		CopyTimeout:    time.Minute,
+		CompileTimeout: 2 * time.Minute,
+		RunTimeout:     5 * time.Minute,
+		JobTimeout:     15 * time.Minute,
+		done:           make(chan bool),
+	}
+}
+
+func (w *Worker) EnsureHomeDir() error {
+	for _, dir := range []string{"judges", "problems"} {
+		dir = filepath.Join(w.HomeDir, dir)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("Error creating home dir '%s': %s", dir, err)
+		}
+	}
+	return nil
+}
+
+func (w *Worker) TryTempDir(i int) bool {
+	w.tempdir = filepath.Join(os.TempDir(), fmt.Sprintf("grz-worker-%04d", i))
+	if _, err := os.Stat(w.tempdir); err != nil {
+		if err := os.Mkdir(w.tempdir, 0700); err != nil {
+			log.Printf("Cannot create '%s': %s", w.tempdir, err)
+			return false
+		}
+		log.Printf("Temporary directory: '%s'", w.tempdir)
+		return true
+	}
+	return false
+}
+
+func (w *Worker) CreateTempDir() error {
+	for i := 0; i < 100; i++ {
+		if w.TryTempDir(i) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Cannot create Temp Dir!")
+}
+
+func (s *Slot) CreateCurrentDir() {
+	if err := os.Mkdir(s.Tmp("current"), 0700); err != nil {
+		log.Printf("Cannot create '%s': %s", s.Tmp("current"), err)
+	}
+}
+
+func (s *Slot) RemoveCurrentDir() {
+	if err := os.RemoveAll(s.Tmp("current")); err != nil {
+		log.Printf("Cannot remove '%s': %s", s.Tmp("current"), err)
+	}
+}
+
+func (w *Worker) RemoveTempDir() {
+	err := os.RemoveAll(w.tempdir)
+	if err != nil {
+		log.Printf("Cannot remove temporary directory '%s': %s", w.tempdir, err)
+	}
+}
+
+func (s *Slot) LinkProblem(problemDir string) {
+	// link problem
+	prob := s.Tmp("current/problem")
+	if _, err := os.Stat(prob); err == nil {
+		err := os.Remove(prob)
+		if err != nil {
+			log.Printf("Cannot remove '%s': %s", prob, err)
+		}
+	}
+	if err := os.Symlink(problemDir, prob); err != nil {
+		log.Printf("Cannot create symlink: %s", err)
+	}
+}
+
+func (s *Slot) AddSolution(solution []byte) error {
+	f, err := os.Create(s.Tmp("current/solution"))
+	if err != nil {
+		return fmt.Errorf("Cannot save solution: %s", err)
+	}
+	f.Write(solution)
+	f.Close()
+	return nil
+}
+
+func Sha1Sum(filename string) (sha1sum string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	sha1 := sha1.New()
+	io.Copy(sha1, file)
+	return fmt.Sprintf("%x", sha1.Sum(nil)), nil
+}
+
+func CopyFile(dest, source string, bytes int64) (written int64, err error) {
+	from, err := os.Open(source)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot open '%s': %s", source, err)
+	}
+	to, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot create '%s': %s", dest, err)
+	}
+	if bytes == -1 {
+		written, err = io.Copy(to, from)
+	} else {
+		written, err = io.CopyN(to, from, bytes)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Cannot CopyFile: %s", err)
+	}
+	// fmt.Printf("Wrote %d bytes\n", written)
+	from.Close()
+	to.Close()
+	return
+}
+
+func (s *Slot) CompileJudgeInVM(judgesrc, judgebin string) error {
+	log.Printf("Compiling judge: %s", judgesrc)
+	base := filepath.Base(judgesrc)
+	lang := LanguageOf(judgesrc)
+	if lang == nil || !lang.Native() {
+		return fmt.Errorf("Language not supported")
+	}
+
+	// Transfer sources to VM
+	s.startPhase("copy", s.w.CopyTimeout)
+	err := s.box.CopyToGuest("/tmp/"+base, judgesrc)
+	if err != nil {
+		return fmt.Errorf("Cannot copy '%s' to guest: %s", judgesrc, err)
+	}
+	s.setupShell()
+
+	// Compile
+	s.startPhase("compile", s.w.CompileTimeout)
+	status, output, err := s.runInVM(lang.CompileCommand("/tmp/"+base, "/tmp/judge.bin"))
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("Judge does not compile:\n%s", output)
+	}
+
+	// Get the binary from VM
+	s.startPhase("copy", s.w.CopyTimeout)
+	err = s.box.CopyToHost(judgebin, "/tmp/judge.bin")
+	if err != nil {
+		return fmt.Errorf("Cannot copy VM file to '%s': %s", judgebin, err)
+	}
+	s.box.Reset()
+	return nil
+}
+
+func (s *Slot) CompileAndLinkJudge(problemDir string) error {
+	// Find judge source
+	results, err := filepath.Glob(filepath.Join(problemDir, "judge.*"))
+	if err != nil {
+		return fmt.Errorf("Cannot glob 'judges.*': %s", err)
+	}
+	candidates := []string{}
+	for _, f := range results {
+		if !strings.HasSuffix(f, "~") { // do not consider backup files
+			candidates = append(candidates, f)
+		}
+	}
+	if len(candidates) > 1 {
+		return fmt.Errorf("Multiple judge source files")
+	} else if len(candidates) == 0 {
+		return fmt.Errorf("No judge source file")
+	}
+	judgesrc := candidates[0]
+
+	// compute Sha1sum of judge source code
+	sha1, err := Sha1Sum(judgesrc)
+	if err != nil {
+		log.Printf("Cannot compute sha1sum of '%s': %s", judgesrc, err)
+	}
+
+	// Look for already compiled judge, otherwise compile it (with a
+	// name of its own, in case another slot is compiling it too)
+	judgebin := filepath.Join(s.w.HomeDir, "judges/"+sha1)
+	if s.w.SandboxType != QEmuSandbox {
+		judgebin += "." + s.w.SandboxType // (not for the VM)
+	}
+	if _, err1 := os.Stat(judgebin); err1 != nil {
+		newbin := fmt.Sprintf("%s.%d", judgebin, s.id)
+		if err2 := s.CompileJudgeInVM(judgesrc, newbin); err2 != nil {
+			os.Remove(newbin)
+			return fmt.Errorf("Cannot compile: %s", err2)
+		}
+		if err := os.Rename(newbin, judgebin); err != nil {
+			return fmt.Errorf("Cannot move '%s': %s", newbin, err)
+		}
+	}
+
+	// Link judge
+	if err := os.Symlink(judgebin, s.Tmp("current/judge")); err != nil {
+		return fmt.Errorf("Cannot create symlink: %s", err)
+	}
+
+	// Chmod +x
+	if err := os.Chmod(judgebin, 0700); err != nil {
+		return fmt.Errorf("Cannot make '%s' executable", judgebin)
+	}
+
+	return nil
+}
+
+// PrepareCDROM puts the files of a job in the directory that will be
+// the CD-ROM of the sandbox.
+func (s *Slot) PrepareCDROM(problemDir string, solution []byte) error {
+	// Check Problem dir
+	if info, err := os.Stat(problemDir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("'%s' is not a directory", problemDir)
+		}
+	} else {
+		return fmt.Errorf("'%s' does not exist", problemDir)
+	}
+	s.LinkProblem(problemDir)
+	if err := s.AddSolution(solution); err != nil {
+		return err
+	}
+	return s.WriteRunScript()
+}
+
+func (s *Slot) Eval(problemDir string, task gsrv.Task, report func(msg string)) (verdict gsrv.Verdict, err error) {
+	s.CreateCurrentDir()
+	defer s.RemoveCurrentDir()
+
+	if s.box.Interrupted() {
+		return verdict, fmt.Errorf("Cancelled")
+	}
+	judge := task.Manifest.Judge
+	switch judge {
+	case gsrv.CustomJudge, gsrv.StandardJudge, gsrv.InteractiveJudge:
+	default:
+		return verdict, fmt.Errorf("Judge type '%s' not supported", judge)
+	}
+	report("Preparing...")
+
+	s.startJob()
+	defer func() {
+		if v := s.endJob(); v != nil {
+			verdict, err = *v, nil
+		}
+	}()
+
+	if judge == gsrv.CustomJudge {
+		if err := s.CompileAndLinkJudge(problemDir); err != nil {
+			return verdict, err
+		}
+	}
+	if err := s.PrepareCDROM(problemDir, task.Data); err != nil {
+		return verdict, err
+	}
+	s.startPhase("copy", s.w.CopyTimeout)
+	s.box.Reset()
+	if err := s.box.Insert(s.Tmp("current")); err != nil {
+		return verdict, err
+	}
+
+	switch judge {
+	case gsrv.StandardJudge:
+		verdict, err = s.EvalStandard(problemDir, task.Manifest, task.Language, report)
+	case gsrv.InteractiveJudge:
+		verdict, err = s.EvalInteractive(problemDir, task.Manifest, task.Language, report)
+	default:
+		verdict, err = s.EvalCustom(task.Language, report)
+	}
+	if s.box.Interrupted() {
+		log.Printf("Evaluation cancelled")
+		s.box.Reset()
+		s.box.Eject()
+		return verdict, fmt.Errorf("Cancelled")
+	}
+	if err == nil {
+		log.Printf("Verdict: %s", verdict.Status)
+	}
+	s.box.Eject()
+	return
+}
+
+// EvalCustom runs the judge of the problem, which reads the solution
+// from stdin, with 'garzon.sh'. If the submission has a language,
+// the solution is compiled first (into '/tmp/solution', where the judge
+// can use it).
+func (s *Slot) EvalCustom(language string, report func(msg string)) (verdict gsrv.Verdict, err error) {
+	if language != "" {
+		lang := FindLanguage(language)
+		if lang == nil {
+			return verdict, fmt.Errorf("Language '%s' not supported", language)
+		}
+		s.startPhase("compile", s.w.CompileTimeout)
+		s.box.Shell("mount /dev/cdrom /mnt/cdrom")
+		s.setupShell()
+		report("Compiling...")
+		ok, msg, err := s.compileSolution(lang)
+		s.box.Shell("umount /mnt/cdrom")
+		if err != nil {
+			return verdict, err
+		}
+		if !ok {
+			return gsrv.Verdict{Status: gsrv.CompileError, Message: msg}, nil
+		}
+	}
+
+	var (
+		nlin       int
+		hash       string
+		isVeredict bool
+		output     string
+	)
+	s.startPhase("judge", s.w.RunTimeout)
+	s.box.ShellReport("garzon.sh", func(line string) {
+		nlin++
+		switch {
+		case nlin == 1:
+			hash = line
+		case line == hash:
+			isVeredict = true
+		default:
+			line = strings.TrimSuffix(line, "\r")
+			if isVeredict {
+				output += line + "\n" // FIXME: \r por aquí?
+			} else {
+				log.Printf("report: '%s'\n", line)
+				report(line)
+			}
+		}
+	}) // execute judge
+	if output == "" {
+		return gsrv.Verdict{Status: gsrv.JudgeError, Message: "Judge Failed"}, nil
+	}
+	return gsrv.ParseVerdict(output), nil
+}
+
+func ensureTempDir(tmpdir string) error {
+	err := os.RemoveAll(tmpdir)
+	if err != nil {
+		return fmt.Errorf("Cannot remove tmp dir '%s': %s", tmpdir, err)
+	}
+	err = os.Mkdir(tmpdir, 0700)
+	if err != nil {
+		return fmt.Errorf("Cannot create tmp dir '%s': %s", tmpdir, err)
+	}
+	return nil
+}
+
+// Capabilities returns what this worker offers to the server.
+func (w *Worker) Capabilities() gsrv.Capabilities {
+	caps := gsrv.Capabilities{
+		Image:     w.Image,
+		Languages: w.Languages,
+		Versions:  w.versions,
+		Arch:      "i386", // qemu-system-i386
+		Labels:    w.Labels,
+	}
+	if w.SandboxType == LocalSandbox {
+		caps.Image, caps.Arch = LocalSandbox, runtime.GOARCH
+	}
+	return caps
+}
+
+// hello introduces the worker to the server, proving that it knows the
+// secret if the server asks for it.
+func (w *Worker) hello(ws *websocket.Conn) error {
+	if err := gsrv.Send(ws, gsrv.MsgHello, "", w.Capabilities()); err != nil {
+		return err
+	}
+	reply, err := gsrv.Receive(ws)
+	if err != nil {
+		return err
+	}
+	if reply.Type == gsrv.MsgChallenge {
+		var nonce string
+		if err := reply.Decode(&nonce); err != nil {
+			return err
+		}
+		if err := gsrv.Send(ws, gsrv.MsgAuth, "", gsrv.Sign(w.Secret, nonce)); err != nil {
+			return err
+		}
+		if reply, err = gsrv.Receive(ws); err != nil {
+			return err
+		}
+	}
+	switch reply.Type {
+	case gsrv.MsgWelcome:
+		return nil
+	case gsrv.MsgReject:
+		var reason string
+		reply.Decode(&reason)
+		return rejectedError(reason)
+	}
+	return fmt.Errorf("Unexpected '%s' reply to hello", reply.Type)
+}
+
+// A rejectedError is returned by hello when the server does not accept
+// the worker (connecting again would not help).
+type rejectedError string
+
+func (e rejectedError) Error() string {
+	return fmt.Sprintf("Rejected by server: %s", string(e))
+}
+
+// connect dials the server until it accepts the worker, and returns nil
+// if the worker is closed meanwhile. It gives up if the server rejects
+// the worker.
+func (w *Worker) connect() (*websocket.Conn, error) {
+	origin := fmt.Sprintf("http://%s/", w.Server)
+	url := fmt.Sprintf("ws://%s/_new_worker", w.Server)
+	for {
+		ws, err := websocket.Dial(url, "", origin)
+		if err == nil {
+			if err = w.hello(ws); err == nil {
+				return ws, nil
+			}
+			ws.Close()
+			if _, ok := err.(rejectedError); ok {
+				return nil, err
+			}
+		}
+		log.Printf("Error connecting: %s", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-w.done:
+			return nil, nil
+		}
+		log.Printf("Retrying...")
+	}
+}
+
+// readMessages receives messages from the server in a goroutine, so that
+// cancellations and pings are handled while a job is being evaluated.
+// Other messages are passed on, until 'done' is closed.
+func (s *Slot) readMessages(ws *websocket.Conn, done chan bool) <-chan *gsrv.Message {
+	incoming := make(chan *gsrv.Message)
+	go func() {
+		defer close(incoming)
+		for {
+			msg, err := gsrv.Receive(ws)
+			if err != nil {
+				log.Printf("Cannot receive: %s", err)
+				return
+			}
+			switch msg.Type {
+			case gsrv.MsgPing:
+				if err := gsrv.Send(ws, gsrv.MsgPong, "", s.Status()); err != nil {
+					log.Printf("Cannot send pong: %s", err)
+				}
+				continue
+
+			case gsrv.MsgSubmit:
+				s.setCurrentJob(msg.JobID)
+				s.box.ClearInterrupt()
+
+			case gsrv.MsgCancel:
+				s.currentJob.Lock()
+				if msg.JobID == s.currentJob.id {
+					log.Printf("Job '%s' cancelled", msg.JobID)
+					s.box.Interrupt()
+				}
+				s.currentJob.Unlock()
+				continue
+			}
+			select {
+			case incoming <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return incoming
+}
+
+// expect is like gsrv.Expect for messages coming from readMessages.
+func expect(incoming <-chan *gsrv.Message, typ, jobID string) (*gsrv.Message, error) {
+	msg, ok := <-incoming
+	if !ok {
+		return nil, fmt.Errorf("Connection closed")
+	}
+	if msg.Type != typ || msg.JobID != jobID {
+		return nil, fmt.Errorf("Expected '%s' for job '%s', got '%s' for job '%s'",
+			typ, jobID, msg.Type, msg.JobID)
+	}
+	return msg, nil
+}
+
+// Start creates the directories of the worker and starts its sandboxes.
+func (w *Worker) Start() error {
+	for _, name := range w.Languages {
+		if FindLanguage(name) == nil {
+			return fmt.Errorf("Unknown language '%s'", name)
+		}
+	}
+	if w.VMs < 1 {
+		return fmt.Errorf("There must be at least one VM")
+	}
+	if w.NewSandbox == nil && w.SandboxType != QEmuSandbox && w.SandboxType != LocalSandbox {
+		return fmt.Errorf("Unknown sandbox '%s'", w.SandboxType)
+	}
+	if err := w.EnsureHomeDir(); err != nil {
+		return err
+	}
+	if err := w.CreateTempDir(); err != nil {
+		return err
+	}
+	for i := 0; i < w.VMs; i++ {
+		slot, err := NewSlot(w, i)
+		if err != nil {
+			w.Kill()
+			return fmt.Errorf("Cannot start VM %d: %s", i, err)
+		}
+		w.mu.Lock()
+		w.slots = append(w.slots, slot)
+		w.mu.Unlock()
+	}
+	w.versions = w.slots[0].LanguageVersions(w.Languages)
+	return nil
+}
+
+// Serve evaluates jobs from the server with all the slots, each one with
+// its own connection, until the worker is closed. If a slot fails (the
+// server rejects the worker or a sandbox is lost), all of them stop and
+// Serve returns the error.
+func (w *Worker) Serve() error {
+	errs := make(chan error, len(w.slots))
+	for _, slot := range w.slots {
+		w.wg.Add(1)
+		go func(slot *Slot) {
+			defer w.wg.Done()
+			if err := slot.Serve(); err != nil {
+				errs <- fmt.Errorf("Slot %d: %s", slot.id, err)
+				w.stop()
+			}
+		}(slot)
+	}
+	w.wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Close disconnects the slots from the server, stopping the jobs being
+// evaluated, waits for Serve to stop the sandboxes and removes the
+// temporary directory.
+func (w *Worker) Close() {
+	w.stop()
+	w.wg.Wait()
+	w.RemoveTempDir()
+}
+
+// stop disconnects the slots and interrupts their jobs.
+func (w *Worker) stop() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.done)
+	}
+	for _, s := range w.slots {
+		if s.ws != nil {
+			s.ws.Close()
+		}
+		s.box.Interrupt()
+	}
+	w.mu.Unlock()
+}
+
+// Kill stops the sandboxes at once and removes the temporary directory
+// (e.g. when the process is terminated).
+func (w *Worker) Kill() {
+	w.mu.Lock()
+	for _, s := range w.slots {
+		s.box.Kill()
+	}
+	w.mu.Unlock()
+	w.RemoveTempDir()
+}
+
+// Serve evaluates the jobs that the server sends to the slot, until the
+// worker is closed or the slot fails.
+func (s *Slot) Serve() error {
+	var (
+		err             error
+		msg, problemDir string
+		verdict         gsrv.Verdict
+	)
+	defer func() {
+		if err := s.box.Quit(); err != nil {
+			log.Printf("Slot %d: %s", s.id, err)
+		}
+	}()
+	for {
+		var ws *websocket.Conn
+		if ws, err = s.w.connect(); ws == nil {
+			return err
+		}
+		s.w.mu.Lock()
+		if s.w.closed {
+			s.w.mu.Unlock()
+			ws.Close()
+			return nil
+		}
+		s.ws = ws
+		s.w.mu.Unlock()
+		log.Printf("Slot %d connected!", s.id)
+		done := make(chan bool)
+		incoming := s.readMessages(ws, done)
+
+		for {
+			// Receive job
+			req, ok := <-incoming
+			if !ok {
+				break
+			}
+			if req.Type != gsrv.MsgSubmit {
+				log.Printf("Unexpected '%s' message", req.Type)
+				break
+			}
+			var task gsrv.Task
+			if err := req.Decode(&task); err != nil {
+				log.Printf("%s", err)
+				break
+			}
+			jobID := req.JobID
+			id := task.ProblemID
+			data := task.Data
+			log.Printf("Received job '%s' (%s, \"%s\"): %d bytes", jobID, id, task.Manifest.Title, len(data))
+			log.Printf("Data:\n%s", data)
+
+			// Use the cached problem or ask for it
+			if problemDir = s.w.CachedProblem(task.ProblemHash); problemDir != "" {
+				gsrv.Send(ws, gsrv.MsgReady, jobID, nil)
+				log.Printf("Problem '%s' found in cache", id)
+				goto eval
+			}
+			gsrv.Send(ws, gsrv.MsgNeedProblem, jobID, nil)
+			{
+				var (
+					problem gsrv.Problem
+					reply   *gsrv.Message
+				)
+				reply, err = expect(incoming, gsrv.MsgProblem, jobID)
+				if err != nil {
+					log.Printf("Error receiving tar.gz: %s", err)
+					break
+				}
+				if err = reply.Decode(&problem); err != nil {
+					msg = "Error receiving tar.gz"
+					goto fail
+				}
+				log.Printf("Received problem: %d bytes", len(problem.Targz))
+
+				// Uncompress into the cache
+				if problemDir, err = s.w.AddProblem(task.ProblemHash, problem.Targz); err != nil {
+					msg = "Cannot add problem"
+					goto fail
+				}
+			}
+
+		eval:
+			// Eval
+			verdict, err = s.Eval(problemDir, task, func(update string) {
+				gsrv.Send(ws, gsrv.MsgProgress, jobID, update)
+			})
+			if err != nil {
+				msg = "Eval error"
+				goto fail
+			}
+			log.Printf("VERDICT: %s", verdict.Status)
+			s.setCurrentJob("")
+			gsrv.Send(ws, gsrv.MsgVerdict, jobID, verdict)
+			if s.lost != nil {
+				break
+			}
+			continue
+
+		fail:
+			log.Printf("%s: %s", msg, err)
+			s.setCurrentJob("")
+			gsrv.Send(ws, gsrv.MsgVerdict, jobID, gsrv.Verdict{
+				Status:  gsrv.JudgeError,
+				Message: fmt.Sprintf("%s: %s", msg, err),
+			})
+		}
+
+		// Close connection
+		close(done)
+		s.setCurrentJob("")
+		s.w.mu.Lock()
+		s.ws = nil
+		s.w.mu.Unlock()
+		ws.Close()
+		if s.lost != nil {
+			return s.lost
+		}
+		select {
+		case <-s.w.done:
+			return nil
+		default:
+		}
+	}
+}